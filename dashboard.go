@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Latest state of a team, as of the last run
+type DashboardTeam struct {
+	TeamID    int
+	ProjectID int
+	Project   string
+	// 0 if the cursus the team was retrieved through wasn't recorded
+	CursusID     int
+	Logins       []string
+	Status       string
+	LastCommit   *time.Time
+	ExpiresAt    *time.Time
+	VacationDays float64
+	Warnings     int
+	Closures     int
+	Error        string
+}
+
+// Criteria from the dashboard's query string; empty fields match every team
+type DashboardFilter struct {
+	Project string
+	Cursus  string
+	Login   string
+}
+
+type DashboardProject struct {
+	ID   int
+	Name string
+}
+
+// Days until the team is stagnant, negative once it is past its expiration
+func (team *DashboardTeam) DaysRemaining() float64 {
+	if team.ExpiresAt == nil {
+		return 0
+	}
+	return time.Until(*team.ExpiresAt).Hours() / 24
+}
+
+// Projects match by ID, slug or part of their name, and logins exactly
+func (filter *DashboardFilter) matches(team *DashboardTeam) bool {
+	if filter.Project != "" {
+		project := strings.ToLower(filter.Project)
+		if strconv.Itoa(team.ProjectID) != project &&
+			getProjectSlug(team.ProjectID) != project &&
+			!strings.Contains(strings.ToLower(team.Project), project) {
+			return false
+		}
+	}
+	if filter.Cursus != "" && strconv.Itoa(team.CursusID) != filter.Cursus {
+		return false
+	}
+	if filter.Login != "" && !containsString(team.Logins, strings.ToLower(filter.Login)) {
+		return false
+	}
+	return true
+}
+
+// Staff sign in with DASHBOARD_USER and DASHBOARD_PASSWORD; without a password the dashboard is only mounted when
+// serve is explicitly told to run it open, to anyone who can reach ServeAddress
+func dashboardAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		password := os.Getenv("DASHBOARD_PASSWORD")
+		if password != "" {
+			user, pass, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(user), []byte(os.Getenv("DASHBOARD_USER"))) != 1 ||
+				subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="GitCreeper"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func renderDashboard(w http.ResponseWriter, name string, data interface{}) {
+	tmpl, err := htmltemplate.New(name).Funcs(htmltemplate.FuncMap(templateFuncs(config.DefaultLanguage))).ParseFS(getTemplateFS(), name)
+	if err == nil {
+		buff := &strings.Builder{}
+		if err = tmpl.Execute(buff, data); err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(buff.String()))
+			return
+		}
+	}
+	logError(err, "step", stepServe, "template", name)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// Teams checked in the last run, most urgent first
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/dashboard" && r.URL.Path != "/dashboard/" {
+		http.NotFound(w, r)
+		return
+	}
+	filter := DashboardFilter{
+		Project: strings.TrimSpace(r.FormValue("project")),
+		Cursus:  strings.TrimSpace(r.FormValue("cursus")),
+		Login:   strings.TrimSpace(r.FormValue("login")),
+	}
+	run, err := getLastRunID("creep")
+	var teams []DashboardTeam
+	if err == nil {
+		teams, err = getRunChecks(run)
+	}
+	if err != nil {
+		logError(err, "step", stepServe)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	projects := make(map[int]string)
+	cursuses := make(map[int]bool)
+	matched := []DashboardTeam{}
+	totals := make(map[string]int)
+	for i := range teams {
+		team := &teams[i]
+		team.Project = getProjectName(team.ProjectID)
+		projects[team.ProjectID] = team.Project
+		if team.CursusID != 0 {
+			cursuses[team.CursusID] = true
+		}
+		if filter.matches(team) {
+			matched = append(matched, *team)
+			totals[team.Status]++
+		}
+	}
+	projectList := make([]DashboardProject, 0, len(projects))
+	for id, name := range projects {
+		projectList = append(projectList, DashboardProject{id, name})
+	}
+	sort.Slice(projectList, func(i, j int) bool { return projectList[i].Name < projectList[j].Name })
+	cursusList := make([]int, 0, len(cursuses))
+	for id := range cursuses {
+		cursusList = append(cursusList, id)
+	}
+	sort.Ints(cursusList)
+	renderDashboard(w, "dashboard.html", struct {
+		RunID    string
+		Filter   DashboardFilter
+		Teams    []DashboardTeam
+		Totals   map[string]int
+		Statuses []string
+		Projects []DashboardProject
+		Cursuses []int
+		Branding Branding
+	}{
+		RunID:    run,
+		Filter:   filter,
+		Teams:    matched,
+		Totals:   totals,
+		Statuses: reportStatuses,
+		Projects: projectList,
+		Cursuses: cursusList,
+		Branding: config.Branding,
+	})
+}
+
+// Every check and action recorded for a team
+func dashboardTeamHandler(w http.ResponseWriter, r *http.Request) {
+	teamID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/dashboard/teams/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	history, err := getTeamHistory(teamID)
+	if err != nil {
+		logError(err, "step", stepServe, "team_id", teamID)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(history) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	// Most recent first
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	renderDashboard(w, "history.html", struct {
+		TeamID   int
+		History  []HistoryEntry
+		Branding Branding
+	}{
+		TeamID:   teamID,
+		History:  history,
+		Branding: config.Branding,
+	})
+}
+
+// Fail closed: without a password, the dashboard is left out unless it was asked to run open
+func mountDashboard(mux *http.ServeMux, open bool) {
+	if os.Getenv("DASHBOARD_PASSWORD") == "" {
+		if !open {
+			logger.Warn("DASHBOARD_PASSWORD is not set, the dashboard is disabled (use --open-dashboard to serve it without signing in)")
+			return
+		}
+		logger.Warn("DASHBOARD_PASSWORD is not set and --open-dashboard was given, the dashboard doesn't require signing in")
+	}
+	mux.HandleFunc("/dashboard", dashboardAuth(dashboardHandler))
+	mux.HandleFunc("/dashboard/", dashboardAuth(dashboardHandler))
+	mux.HandleFunc("/dashboard/teams/", dashboardAuth(dashboardTeamHandler))
+}
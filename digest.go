@@ -0,0 +1,147 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const digestEmail = "digest"
+
+// Order in which statuses appear in the digest, most urgent first
+var digestStatuses = []string{ERROR, STAGNANT, WARNED, CHEAT, EXEMPT, OK}
+
+type (
+	DigestTeam struct {
+		ID         int
+		URL        string
+		Logins     string
+		LastCommit *time.Time
+		Error      string
+	}
+	DigestProject struct {
+		Name  string
+		Teams []DigestTeam
+	}
+	DigestGroup struct {
+		Status   string
+		Count    int
+		Projects []DigestProject
+		// OK teams are only counted per project, since listing them all would bury the rest
+		Detailed bool
+	}
+)
+
+func buildDigestGroups(report *RunReport) []DigestGroup {
+	byStatus := make(map[string]map[string][]DigestTeam)
+	for _, record := range report.Teams {
+		projects, present := byStatus[record.Status]
+		if !present {
+			projects = make(map[string][]DigestTeam)
+			byStatus[record.Status] = projects
+		}
+		projects[record.Project] = append(projects[record.Project], DigestTeam{
+			ID:         record.TeamID,
+			URL:        record.URL,
+			Logins:     strings.Join(record.Logins, ", "),
+			LastCommit: record.LastCommit,
+			Error:      record.Error,
+		})
+	}
+	var groups []DigestGroup
+	for _, status := range digestStatuses {
+		projects, present := byStatus[status]
+		if !present {
+			continue
+		}
+		group := DigestGroup{Status: status, Detailed: status != OK}
+		for name, teams := range projects {
+			group.Projects = append(group.Projects, DigestProject{Name: name, Teams: teams})
+			group.Count += len(teams)
+		}
+		sort.Slice(group.Projects, func(i, j int) bool {
+			return group.Projects[i].Name < group.Projects[j].Name
+		})
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func composeDigest(report *RunReport) (*Message, error) {
+	tfs := getTemplateFS()
+	funcs := templateFuncs(config.DefaultLanguage)
+	htmlTmpl, err := htmltemplate.New("digest.html").Funcs(htmltemplate.FuncMap(funcs)).ParseFS(tfs, "digest.html")
+	if err != nil {
+		return nil, err
+	}
+	textTmpl, err := template.New("digest.txt").Funcs(funcs).ParseFS(tfs, "digest.txt")
+	if err != nil {
+		return nil, err
+	}
+	data := struct {
+		Title         string
+		RunID         string
+		Day           string
+		Total         int
+		Groups        []DigestGroup
+		Errors        []string
+		Undeliverable []UndeliverableMail
+		Branding      Branding
+	}{
+		RunID:         report.RunID,
+		Day:           report.Day,
+		Total:         len(report.Teams),
+		Groups:        buildDigestGroups(report),
+		Errors:        report.Errors,
+		Undeliverable: report.Undeliverable,
+		Branding:      config.Branding,
+	}
+	title := &strings.Builder{}
+	if err := textTmpl.ExecuteTemplate(title, "subject", data); err != nil {
+		return nil, err
+	}
+	data.Title = strings.TrimSpace(title.String())
+	html, text := &strings.Builder{}, &strings.Builder{}
+	if err := htmlTmpl.Execute(html, data); err != nil {
+		return nil, err
+	}
+	if err := textTmpl.Execute(text, data); err != nil {
+		return nil, err
+	}
+	return &Message{
+		From:    config.EmailFromAddress,
+		To:      config.StaffDigestAddresses,
+		Subject: config.Branding.SubjectPrefix + data.Title,
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// Summarize the run for staff, who otherwise only see it through Slack
+func sendDigest(report *RunReport) error {
+	msg, err := composeDigest(report)
+	if err != nil {
+		return err
+	}
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	m := &QueuedMail{
+		Type: digestEmail,
+		From: config.EmailFromAddress,
+		To:   msg.To,
+		Body: body,
+	}
+	if err := enqueueMail(m); err != nil {
+		return err
+	}
+	if err := deliverMail(m); err != nil {
+		logger.Warn("Queued digest email for retry", "to", strings.Join(msg.To, ","), "error", err)
+		return nil
+	}
+	logger.Info("Digest sent", "to", strings.Join(msg.To, ","))
+	return nil
+}
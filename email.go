@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"html/template"
-	"net/smtp"
+	htmltemplate "html/template"
+	"io/fs"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"gitcreeper/intra"
@@ -16,69 +16,229 @@ const (
 	prelaunchEmail = "prelaunch"
 	warningEmail   = "warning"
 	closedEmail    = "closed"
+	reopenedEmail  = "reopened"
 )
 
-func composeEmail(emailType string, body *bytes.Buffer, vars map[string]string) error {
-	tmpl, err := template.ParseFiles(
-		"templates/email.html",
-		fmt.Sprintf("templates/%s.html", emailType),
+// Times are passed through vars in RFC 3339 so that they can be localized when the email is composed
+func encodeTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func decodeTime(str string) *time.Time {
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// Use the language's template if there is one, or the default template otherwise
+func localizedTemplate(tfs fs.FS, lang, name string) string {
+	if lang == config.DefaultLanguage {
+		return name
+	}
+	if _, err := fs.Stat(tfs, lang+"/"+name); err == nil {
+		return lang + "/" + name
+	}
+	return name
+}
+
+// Templates come in pairs: <type>.html and <type>.txt, wrapped by email.html and email.txt
+// The subject is defined by the "subject" block of <type>.txt, unless overridden by a warning stage
+// Localized templates live in a subdirectory named after the language, e.g. fr/closed.txt
+func composeEmail(emailType string, vars map[string]string, policy *Policy) (*Message, error) {
+	tfs := getTemplateFS()
+	lang := vars["language"]
+	if lang == "" {
+		lang = config.DefaultLanguage
+	}
+	locale := getLocale(lang)
+	funcs := templateFuncs(lang)
+	htmlTmpl, err := htmltemplate.New("email.html").Funcs(htmltemplate.FuncMap(funcs)).ParseFS(
+		tfs,
+		localizedTemplate(tfs, lang, "email.html"),
+		localizedTemplate(tfs, lang, emailType+".html"),
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var title string
-	if emailType == warningEmail {
-		title = "%s Nearing Update Deadline"
-	} else {
-		title = "Insufficient Progress on %s"
-	}
-	err = tmpl.Execute(body, struct {
-		From              string
-		To                string
-		Title             string
-		ProjectName       string
-		LastCommitDate    string
-		TimeElapsed       string
-		LaunchDate        string
-		DaysUntilStagnant int
-		DaysToCorrect     int
-	}{
-		From:              config.EmailFromAddress,
-		To:                vars["to"],
-		Title:             fmt.Sprintf(title, vars["projectName"]),
-		ProjectName:       vars["projectName"],
-		LastCommitDate:    vars["lastUpdate"],
-		TimeElapsed:       vars["timeElapsed"],
-		LaunchDate:        config.StartClosingAt.Local().Format(time.RFC822),
-		DaysUntilStagnant: config.DaysUntilStagnant,
-		DaysToCorrect:     config.DaysToCorrect,
-	})
+	textTmpl, err := template.New("email.txt").Funcs(funcs).ParseFS(
+		tfs,
+		localizedTemplate(tfs, lang, "email.txt"),
+		localizedTemplate(tfs, lang, emailType+".txt"),
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n"))
-	return nil
+	lastCommit := decodeTime(vars["lastUpdate"])
+	userLastCommit := decodeTime(vars["userLastUpdate"])
+	remaining, _ := time.ParseDuration(vars["remaining"])
+	data := struct {
+		Language           string
+		Login              string
+		Teammates          string
+		LastCommit         *time.Time
+		UserLastCommit     *time.Time
+		UserLastCommitDate string
+		VacationDays       string
+		StatusLinks        []StatusLink
+		Title              string
+		ProjectName        string
+		LastCommitDate     string
+		TimeElapsed        string
+		Remaining          time.Duration
+		TimeRemaining      string
+		LaunchDate         string
+		DaysUntilStagnant  int
+		DaysToCorrect      int
+		Branding           Branding
+	}{
+		Language:           lang,
+		Login:              vars["login"],
+		Teammates:          vars["teammates"],
+		LastCommit:         lastCommit,
+		UserLastCommit:     userLastCommit,
+		UserLastCommitDate: locale.DateOrNever(userLastCommit),
+		VacationDays:       vars["vacationDays"],
+		StatusLinks:        getStatusLinks(vars["statusLogins"]),
+		ProjectName:        vars["projectName"],
+		LastCommitDate:     locale.DateOrNever(lastCommit),
+		TimeElapsed:        locale.Elapsed(lastCommit),
+		Remaining:          remaining,
+		TimeRemaining:      locale.Duration(remaining),
+		LaunchDate:         locale.Date(config.StartClosingAt),
+		DaysUntilStagnant:  policy.DaysUntilStagnant,
+		DaysToCorrect:      policy.DaysToCorrect,
+		Branding:           config.Branding,
+	}
+	if subject := vars["subject"]; subject != "" {
+		data.Title = strings.ReplaceAll(subject, "%s", data.ProjectName)
+	} else if textTmpl.Lookup("subject") != nil {
+		title := &strings.Builder{}
+		if err := textTmpl.ExecuteTemplate(title, "subject", data); err != nil {
+			return nil, err
+		}
+		data.Title = strings.TrimSpace(title.String())
+	} else {
+		return nil, fmt.Errorf("%s.txt does not define a subject", emailType)
+	}
+	html, text := &strings.Builder{}, &strings.Builder{}
+	if err := htmlTmpl.Execute(html, data); err != nil {
+		return nil, err
+	}
+	if err := textTmpl.Execute(text, data); err != nil {
+		return nil, err
+	}
+	return &Message{
+		From:    config.EmailFromAddress,
+		To:      strings.Split(vars["to"], ","),
+		Subject: config.Branding.SubjectPrefix + data.Title,
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
 }
 
 func sendEmail(team *intra.Team, lastUpdate *time.Time, emailType string) error {
-	to := make([]string, len(team.Users))
+	return sendEmailWithVars(team, lastUpdate, emailType, map[string]string{})
+}
+
+// Time left before expiresAt, in whole hours; teams checked after entering the stage have less than the full stage
+// left. Without an expiry, e.g. when previewing, the stage's own duration is used
+func getWarningVars(stage *WarningStage, expiresAt time.Time) map[string]string {
+	remaining := stage.Duration()
+	if !expiresAt.IsZero() {
+		remaining = time.Until(expiresAt).Truncate(time.Hour)
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+	return map[string]string{
+		"subject":   stage.Subject,
+		"remaining": remaining.String(),
+	}
+}
+
+func sendWarningEmail(team *intra.Team, lastUpdate *time.Time, stage *WarningStage, expiresAt time.Time) error {
+	return sendEmailWithVars(team, lastUpdate, stage.Template, getWarningVars(stage, expiresAt))
+}
+
+func studentAddress(login string) string {
+	return fmt.Sprintf("%s@student.%s", login, config.CampusDomain)
+}
+
+func setEmailVars(team *intra.Team, lastUpdate *time.Time, vars map[string]string) {
+	vars["projectName"] = getProjectName(team.ProjectID)
+	vars["lastUpdate"] = encodeTime(lastUpdate)
+	vars["statusLogins"] = strings.Join(getIntraIDs(team), ",")
+}
+
+func sendEmailWithVars(team *intra.Team, lastUpdate *time.Time, emailType string, vars map[string]string) error {
+	setEmailVars(team, lastUpdate, vars)
+	if !config.EmailPerStudent {
+		to := make([]string, len(team.Users))
+		for i := range team.Users {
+			to[i] = studentAddress(team.Users[i].Login)
+		}
+		vars["to"] = strings.Join(to, ",")
+		vars["language"] = getTeamLanguage(team)
+		return queueEmail(team, emailType, vars)
+	}
+	// Each member gets their own message, so addresses aren't shared and content can be personalized
 	for i := range team.Users {
-		to[i] = fmt.Sprintf("%s@student.%s", team.Users[i].Login, config.CampusDomain)
+		login := team.Users[i].Login
+		userVars := make(map[string]string, len(vars)+5)
+		for k, v := range vars {
+			userVars[k] = v
+		}
+		var teammates []string
+		for j := range team.Users {
+			if j != i {
+				teammates = append(teammates, team.Users[j].Login)
+			}
+		}
+		userVars["to"] = studentAddress(login)
+		userVars["login"] = login
+		userVars["statusLogins"] = login
+		userVars["teammates"] = strings.Join(teammates, ", ")
+		userLastUpdate, err := getUserLastUpdate(team, login)
+		if err != nil {
+			logError(err, "step", stepSSH, "team_id", team.ID, "login", login)
+		}
+		userVars["userLastUpdate"] = encodeTime(userLastUpdate)
+		userVars["language"] = getUserLanguage(login)
+		userVars["vacationDays"] = strconv.Itoa(getUserVacationDays(team, login, lastUpdate))
+		if err := queueEmail(team, emailType, userVars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queueEmail(team *intra.Team, emailType string, vars map[string]string) error {
+	msg, err := composeEmail(emailType, vars, getPolicy(team))
+	if err != nil {
+		return err
 	}
-	vars := map[string]string{
-		"to":          strings.Join(to, ","),
-		"projectName": getProjectName(team.ProjectID),
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
 	}
-	if lastUpdate != nil {
-		vars["lastUpdate"] = lastUpdate.Local().Format(time.RFC1123)
-		vars["timeElapsed"] = strconv.Itoa(int(time.Now().UTC().Sub(*lastUpdate).Hours()/24)) + " days ago"
-	} else {
-		vars["lastUpdate"] = "NEVER"
-		vars["timeElapsed"] = "never"
+	m := &QueuedMail{
+		TeamID: team.ID,
+		Type:   emailType,
+		From:   config.EmailFromAddress,
+		To:     msg.To,
+		Body:   body,
 	}
-	body := &bytes.Buffer{}
-	if err := composeEmail(emailType, body, vars); err != nil {
+	if err := enqueueMail(m); err != nil {
 		return err
 	}
-	return smtp.SendMail(config.EmailServerAddress, nil, config.EmailFromAddress, to, body.Bytes())
+	// The message is safely spooled, so a delivery failure only delays it until the next flush
+	if err := deliverMail(m); err != nil {
+		logger.Warn("Queued email for retry", "team_id", team.ID, "type", emailType, "to", vars["to"], "error", err)
+	}
+	return nil
 }
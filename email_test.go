@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetWarningVarsPartwayThroughStage(t *testing.T) {
+	stage := &WarningStage{HoursBefore: 24, Template: warningEmail}
+	// Checked six and a half hours after entering the 24h stage
+	vars := getWarningVars(stage, time.Now().Add(17*time.Hour+30*time.Minute))
+	if vars["remaining"] != (17 * time.Hour).String() {
+		t.Errorf("remaining is %s, want 17h, rounded down", vars["remaining"])
+	}
+	if vars := getWarningVars(stage, time.Now().Add(-time.Hour)); vars["remaining"] != "0s" {
+		t.Errorf("remaining is %s past the deadline", vars["remaining"])
+	}
+	// Previews have no deadline and show the whole stage
+	if vars := getWarningVars(stage, time.Time{}); vars["remaining"] != (24 * time.Hour).String() {
+		t.Errorf("remaining is %s without a deadline", vars["remaining"])
+	}
+}
+
+func TestWarningEmailRemaining(t *testing.T) {
+	saved, savedLocation := config, location
+	defer func() { config, location = saved, savedLocation }()
+	config.TemplatePath = "templates"
+	config.DefaultLanguage = defaultLanguage
+	config.Languages = []string{"fr"}
+	location = time.UTC
+
+	stage := &WarningStage{HoursBefore: 24, Template: warningEmail}
+	vars := getWarningVars(stage, time.Now().Add(17*time.Hour+30*time.Minute))
+	vars["projectName"] = "libft"
+	vars["to"] = "alogin@student.42.us.org"
+	vars["language"] = "fr"
+	msg, err := composeEmail(warningEmail, vars, &Policy{DaysUntilStagnant: 7, DaysToCorrect: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.Text, "d’ici 17 heures") {
+		t.Errorf("warning doesn't give the 17 hours left:\n%s", msg.Text)
+	}
+}
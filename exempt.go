@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+// Team or student that is never warned or closed, optionally only for one project and until some time
+type Exemption struct {
+	ID int
+	// Set for exemptions of a single team
+	TeamID int
+	// Set for exemptions of every team a student is part of
+	Login string
+	// 0 for every project
+	ProjectID int
+	Reason    string
+	ExpiresAt *time.Time
+	Author    string
+	CreatedAt time.Time
+	RemovedAt *time.Time
+}
+
+func (exemption *Exemption) matches(team *intra.Team) bool {
+	if exemption.ProjectID != 0 && exemption.ProjectID != team.ProjectID {
+		return false
+	}
+	if exemption.TeamID != 0 {
+		return exemption.TeamID == team.ID
+	}
+	return containsString(getIntraIDs(team), exemption.Login)
+}
+
+func (exemption *Exemption) String() string {
+	subject := "team " + strconv.Itoa(exemption.TeamID)
+	if exemption.TeamID == 0 {
+		subject = "login " + exemption.Login
+	}
+	if exemption.ProjectID != 0 {
+		subject += " on " + getProjectName(exemption.ProjectID)
+	}
+	until := "indefinitely"
+	if exemption.ExpiresAt != nil {
+		// Exemptions expire at the midnight following their last day
+		until = "through " + exemption.ExpiresAt.Add(-time.Second).In(location).Format(dayFormat)
+	}
+	return fmt.Sprintf("%s %s (%s, by %s): %s", subject, until, exemption.CreatedAt.In(location).Format(dayFormat),
+		exemption.Author, exemption.Reason)
+}
+
+// Return the first exemption applying to a team, or nil if it isn't exempt
+func findExemption(exemptions []Exemption, team *intra.Team) *Exemption {
+	for i := range exemptions {
+		if exemptions[i].matches(team) {
+			return &exemptions[i]
+		}
+	}
+	return nil
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func exemptAddCommand(args []string) error {
+	fs := flag.NewFlagSet("exempt add", flag.ExitOnError)
+	teamID := fs.Int("team", 0, "team to exempt")
+	login := fs.String("login", "", "student whose teams to exempt")
+	projectID := fs.Int("project", 0, "only exempt teams of this project ID")
+	reason := fs.String("reason", "", "why the exemption was granted")
+	until := fs.String("until", "", "last day of the exemption, as YYYY-MM-DD (default no expiry)")
+	author := fs.String("author", currentUser(), "staff member granting the exemption")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*teamID == 0) == (*login == "") || *reason == "" || fs.NArg() != 0 {
+		return errors.New(
+			"usage: gitcreeper exempt add (--team <team-id> | --login <login>) [--project <project-id>] " +
+				"--reason <reason> [--until <YYYY-MM-DD>] [--author <login>]",
+		)
+	}
+	exemption := Exemption{
+		TeamID:    *teamID,
+		Login:     strings.ToLower(*login),
+		ProjectID: *projectID,
+		Reason:    *reason,
+		Author:    *author,
+		CreatedAt: time.Now().UTC(),
+	}
+	if *until != "" {
+		day, err := time.ParseInLocation(dayFormat, *until, location)
+		if err != nil {
+			return err
+		}
+		// Exempt through the whole day
+		expiresAt := day.AddDate(0, 0, 1).UTC()
+		exemption.ExpiresAt = &expiresAt
+	}
+	id, err := recordExemption(&exemption)
+	if err != nil {
+		return err
+	}
+	exemption.ID = id
+	logger.Info("Exemption added", "exemption_id", id, "team_id", exemption.TeamID, "login", exemption.Login,
+		"project_id", exemption.ProjectID, "author", exemption.Author)
+	fmt.Printf("Exemption %d added: %s\n", id, exemption.String())
+	return nil
+}
+
+// Manage teams and students that runs never warn or close
+func exemptCommand(args []string) error {
+	usage := errors.New("usage: gitcreeper exempt add | list [--all] | remove <id>...")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "add":
+		return exemptAddCommand(args[1:])
+	case "list":
+		fs := flag.NewFlagSet("exempt list", flag.ExitOnError)
+		all := fs.Bool("all", false, "include expired and removed exemptions")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		exemptions, err := getExemptions(*all)
+		if err != nil {
+			return err
+		}
+		for i := range exemptions {
+			exemption := &exemptions[i]
+			state := ""
+			if exemption.RemovedAt != nil {
+				state = " REMOVED"
+			} else if exemption.ExpiresAt != nil && exemption.ExpiresAt.Before(time.Now()) {
+				state = " EXPIRED"
+			}
+			fmt.Printf("%d%s %s\n", exemption.ID, state, exemption.String())
+		}
+		fmt.Printf("%d exemptions.\n", len(exemptions))
+	case "remove":
+		if len(args) < 2 {
+			return usage
+		}
+		nRemoved := 0
+		for _, arg := range args[1:] {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				return err
+			}
+			removed, err := removeExemption(id)
+			if err != nil {
+				return err
+			}
+			if !removed {
+				logger.Warn("No active exemption with this ID", "exemption_id", id)
+				continue
+			}
+			logger.Info("Exemption removed", "exemption_id", id, "author", currentUser())
+			nRemoved++
+		}
+		fmt.Printf("%d exemptions removed.\n", nRemoved)
+	default:
+		return usage
+	}
+	return nil
+}
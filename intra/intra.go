@@ -11,20 +11,81 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
-var intraCache = make(map[string]interface{})
+var (
+	// Shared by runs and the daemon's request handlers
+	intraCache = make(map[string]interface{})
+	cacheMu    sync.Mutex
+	// Clients are kept by scope so that their access token is reused until it expires
+	clients   = make(map[string]*oauthClient)
+	clientsMu sync.Mutex
+)
 
-func getClient(ctx context.Context, scopes ...string) *http.Client {
+// Called after every request with the response's status code, or 0 if no response was received
+var RequestHook func(method string, statusCode int)
+
+type oauthClient struct {
+	client *http.Client
+	tokens oauth2.TokenSource
+}
+
+func getOAuthClient(scopes ...string) *oauthClient {
+	key := strings.Join(scopes, " ")
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if c, present := clients[key]; present {
+		return c
+	}
 	oauth := clientcredentials.Config{
 		ClientID:     os.Getenv("INTRA_CLIENT_ID"),
 		ClientSecret: os.Getenv("INTRA_CLIENT_SECRET"),
 		TokenURL:     "https://api.intra.42.fr/oauth/token",
 		Scopes:       scopes,
 	}
-	return oauth.Client(ctx)
+	// Tokens outlive any single request, so they are never fetched with a request's context
+	tokens := oauth.TokenSource(context.Background())
+	c := &oauthClient{oauth2.NewClient(context.Background(), tokens), tokens}
+	clients[key] = c
+	return c
+}
+
+func getClient(ctx context.Context, scopes ...string) *http.Client {
+	return getOAuthClient(scopes...).client
+}
+
+// Fetch access tokens ahead of time, refreshing them if they are about to expire
+func WarmUp() error {
+	for _, scopes := range [][]string{{"public"}, {"public", "projects"}} {
+		if _, err := getOAuthClient(scopes...).tokens.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getCached(key string) (interface{}, bool) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	v, present := intraCache[key]
+	return v, present
+}
+
+func setCached(key string, v interface{}) {
+	cacheMu.Lock()
+	intraCache[key] = v
+	cacheMu.Unlock()
+}
+
+// Forget cached objects so that a long-running process doesn't act on stale data
+func ClearCache() {
+	cacheMu.Lock()
+	intraCache = make(map[string]interface{})
+	cacheMu.Unlock()
 }
 
 func getEndpoint(path string, params url.Values) string {
@@ -47,6 +108,13 @@ func runRequest(client *http.Client, method, endpoint string, formData url.Value
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	}
 	resp, err := client.Do(req)
+	if RequestHook != nil {
+		statusCode := 0
+		if err == nil {
+			statusCode = resp.StatusCode
+		}
+		RequestHook(method, statusCode)
+	}
 	if err != nil {
 		return 0, nil, err
 	}
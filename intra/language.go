@@ -0,0 +1,31 @@
+package intra
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+)
+
+type (
+	Language struct {
+		ID         int    `json:"id"`
+		Name       string `json:"name"`
+		Identifier string `json:"identifier"`
+	}
+	Languages []Language
+)
+
+func (languages *Languages) GetAllLanguages(ctx context.Context, params url.Values) error {
+	data, err := getAll(getClient(ctx, "public"), "languages", params)
+	if err != nil {
+		return err
+	}
+	for _, dataPage := range data {
+		var page Languages
+		if err := json.Unmarshal(dataPage, &page); err != nil {
+			return err
+		}
+		*languages = append(*languages, page...)
+	}
+	return nil
+}
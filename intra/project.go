@@ -14,6 +14,16 @@ type (
 		Slug        string `json:"slug"`
 		Description string `json:"description"`
 		Exam        bool   `json:"exam"`
+		Cursus      []struct {
+			ID   int    `json:"id"`
+			Slug string `json:"slug"`
+		} `json:"cursus"`
+		ProjectSessions []struct {
+			ID       int  `json:"id"`
+			Solo     bool `json:"solo"`
+			CampusID *int `json:"campus_id"`
+			CursusID *int `json:"cursus_id"`
+		} `json:"project_sessions"`
 	}
 	Projects []Project
 )
@@ -21,7 +31,7 @@ type (
 func (project *Project) GetProject(ctx context.Context, bypassCache bool, ID int) error {
 	IDStr := strconv.Itoa(ID)
 	endpoint := getEndpoint("projects/"+IDStr, nil)
-	if proj, present := intraCache[endpoint]; !bypassCache && present {
+	if proj, present := getCached(endpoint); !bypassCache && present {
 		*project = proj.(Project)
 		return nil
 	}
@@ -37,7 +47,16 @@ func (project *Project) GetProject(ctx context.Context, bypassCache bool, ID int
 }
 
 func (projects *Projects) GetAllProjects(ctx context.Context, params url.Values) error {
-	data, err := getAll(getClient(ctx, "public"), "projects", params)
+	return projects.getAllProjects(ctx, "projects", params)
+}
+
+// Projects taught in a cursus
+func (projects *Projects) GetCursusProjects(ctx context.Context, cursusID int, params url.Values) error {
+	return projects.getAllProjects(ctx, "cursus/"+strconv.Itoa(cursusID)+"/projects", params)
+}
+
+func (projects *Projects) getAllProjects(ctx context.Context, endpoint string, params url.Values) error {
+	data, err := getAll(getClient(ctx, "public"), endpoint, params)
 	if err != nil {
 		return err
 	}
@@ -47,7 +66,7 @@ func (projects *Projects) GetAllProjects(ctx context.Context, params url.Values)
 			return err
 		}
 		for _, proj := range page {
-			intraCache[getEndpoint("projects/"+strconv.Itoa(proj.ID), nil)] = proj
+			setCached(getEndpoint("projects/"+strconv.Itoa(proj.ID), nil), proj)
 		}
 		*projects = append(*projects, page...)
 	}
@@ -45,7 +45,7 @@ func (team *Team) PatchTeam(ctx context.Context, updateCache bool, params url.Va
 	endpoint := getEndpoint("teams/"+strconv.Itoa(team.ID), nil)
 	status, respData, err := runRequest(getClient(ctx, "public", "projects"), http.MethodPatch, endpoint, params)
 	if err == nil && updateCache {
-		intraCache[team.URL] = *team
+		setCached(team.URL, *team)
 	}
 	return status, respData, err
 }
@@ -53,7 +53,7 @@ func (team *Team) PatchTeam(ctx context.Context, updateCache bool, params url.Va
 func (team *Team) GetTeam(ctx context.Context, bypassCache bool, ID int) error {
 	IDStr := strconv.Itoa(ID)
 	endpoint := getEndpoint("teams/"+IDStr, nil)
-	if t, present := intraCache[endpoint]; !bypassCache && present {
+	if t, present := getCached(endpoint); !bypassCache && present {
 		*team = t.(Team)
 		return nil
 	}
@@ -69,7 +69,16 @@ func (team *Team) GetTeam(ctx context.Context, bypassCache bool, ID int) error {
 }
 
 func (teams *Teams) GetAllTeams(ctx context.Context, params url.Values) error {
-	data, err := getAll(getClient(ctx, "public"), "teams", params)
+	return teams.getAllTeams(ctx, "teams", params)
+}
+
+// Teams a user belongs to, in any project
+func (teams *Teams) GetUserTeams(ctx context.Context, login string, params url.Values) error {
+	return teams.getAllTeams(ctx, "users/"+login+"/teams", params)
+}
+
+func (teams *Teams) getAllTeams(ctx context.Context, endpoint string, params url.Values) error {
+	data, err := getAll(getClient(ctx, "public"), endpoint, params)
 	if err != nil {
 		return err
 	}
@@ -79,7 +88,7 @@ func (teams *Teams) GetAllTeams(ctx context.Context, params url.Values) error {
 			return err
 		}
 		for _, team := range page {
-			intraCache[team.URL] = team
+			setCached(team.URL, team)
 		}
 		*teams = append(*teams, page...)
 	}
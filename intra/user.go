@@ -0,0 +1,41 @@
+package intra
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+type (
+	LanguagesUser struct {
+		ID         int `json:"id"`
+		LanguageID int `json:"language_id"`
+		UserID     int `json:"user_id"`
+		Position   int `json:"position"`
+	}
+	User struct {
+		ID             int             `json:"id"`
+		Login          string          `json:"login"`
+		Email          string          `json:"email"`
+		URL            string          `json:"url"`
+		LanguagesUsers []LanguagesUser `json:"languages_users"`
+	}
+)
+
+// Only the single user endpoint includes preferred languages, so users aren't fetched through getAll
+func (user *User) GetUser(ctx context.Context, bypassCache bool, login string) error {
+	endpoint := getEndpoint("users/"+login, nil)
+	if u, present := getCached(endpoint); !bypassCache && present {
+		*user = u.(User)
+		return nil
+	}
+	_, data, err := runRequest(getClient(ctx, "public"), http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, user); err != nil {
+		return err
+	}
+	setCached(endpoint, *user)
+	return nil
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitcreeper/intra"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Every run, decision and action is persisted so that closures can be explained and reverted later
+var ledger *sql.DB
+
+const ledgerSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id          TEXT PRIMARY KEY,
+	command     TEXT NOT NULL,
+	config_hash TEXT NOT NULL,
+	started_at  TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS checks (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id        TEXT NOT NULL,
+	team_id       INTEGER NOT NULL,
+	project_id    INTEGER NOT NULL,
+	logins        TEXT NOT NULL,
+	status        TEXT NOT NULL,
+	last_commit   TIMESTAMP,
+	vacation_days REAL NOT NULL DEFAULT 0,
+	error         TEXT,
+	checked_at    TIMESTAMP NOT NULL,
+	cursus_id     INTEGER,
+	expires_at    TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS actions (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id   TEXT NOT NULL,
+	team_id  INTEGER NOT NULL,
+	action   TEXT NOT NULL,
+	detail   TEXT NOT NULL,
+	request  TEXT,
+	response TEXT,
+	error    TEXT,
+	time     TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS closures (
+	id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id              TEXT NOT NULL,
+	team_id             INTEGER NOT NULL,
+	closed_at           TIMESTAMP NOT NULL,
+	terminating_at      TIMESTAMP NOT NULL,
+	prev_closed_at      TIMESTAMP,
+	prev_terminating_at TIMESTAMP,
+	last_update         TIMESTAMP,
+	reopened_at         TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS applied (
+	team_id     INTEGER NOT NULL,
+	action      TEXT NOT NULL,
+	day         TEXT NOT NULL,
+	last_commit TEXT NOT NULL,
+	run_id      TEXT NOT NULL,
+	PRIMARY KEY (team_id, action, day)
+);
+CREATE TABLE IF NOT EXISTS errors (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id  TEXT NOT NULL,
+	message TEXT NOT NULL,
+	time    TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS exemptions (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	team_id    INTEGER,
+	login      TEXT,
+	project_id INTEGER,
+	reason     TEXT NOT NULL,
+	expires_at TIMESTAMP,
+	author     TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	removed_at TIMESTAMP,
+	removed_by TEXT
+);
+CREATE INDEX IF NOT EXISTS checks_team ON checks (team_id);
+CREATE INDEX IF NOT EXISTS checks_run ON checks (run_id);
+CREATE INDEX IF NOT EXISTS actions_team ON actions (team_id);
+CREATE INDEX IF NOT EXISTS closures_team ON closures (team_id);
+`
+
+// Columns added since the tables were first created, which ledgers written by older versions lack
+var ledgerColumns = []struct{ table, column, definition string }{
+	{"checks", "cursus_id", "INTEGER"},
+	{"checks", "expires_at", "TIMESTAMP"},
+}
+
+func migrateLedger(db *sql.DB) error {
+	for _, c := range ledgerColumns {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", c.table, c.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func openLedger(path string) error {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(ledgerSchema); err != nil {
+		_ = db.Close()
+		return err
+	}
+	if err := migrateLedger(db); err != nil {
+		_ = db.Close()
+		return err
+	}
+	ledger = db
+	return nil
+}
+
+func closeLedger() {
+	if ledger != nil {
+		_ = ledger.Close()
+	}
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func nullError(err error) *string {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	return &msg
+}
+
+func startRun(command string) {
+	_, err := ledger.Exec(
+		"INSERT INTO runs (id, command, config_hash, started_at) VALUES (?, ?, ?, ?)",
+		currentRunID(), command, configHash, time.Now().UTC(),
+	)
+	if err != nil {
+		logError(err, "step", stepLedger)
+	}
+}
+
+func finishRun() {
+	_, err := ledger.Exec("UPDATE runs SET finished_at = ? WHERE id = ?", time.Now().UTC(), currentRunID())
+	if err != nil {
+		logError(err, "step", stepLedger)
+	}
+}
+
+func recordCheck(
+	team *intra.Team,
+	status string,
+	lastUpdate *time.Time,
+	vacationTime time.Duration,
+	expiresAt *time.Time,
+	checkErr error,
+) {
+	var cursusID *int
+	if id, present := teamCursus[team.ID]; present {
+		cursusID = &id
+	}
+	_, err := ledger.Exec(
+		`INSERT INTO checks
+		(run_id, team_id, project_id, logins, status, last_commit, vacation_days, error, checked_at, cursus_id, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		currentRunID(),
+		team.ID,
+		team.ProjectID,
+		strings.Join(getIntraIDs(team), ","),
+		status,
+		lastUpdate,
+		vacationTime.Hours()/24.0,
+		nullError(checkErr),
+		time.Now().UTC(),
+		cursusID,
+		expiresAt,
+	)
+	if err != nil {
+		logError(err, "step", stepLedger)
+	}
+}
+
+// Append an action to the audit trail, along with the Intra request and response if there was one
+func recordAction(action string, teamID int, detail string, request url.Values, response []byte, actionErr error) {
+	var req, resp *string
+	if request != nil {
+		encoded := request.Encode()
+		req = &encoded
+	}
+	if response != nil {
+		str := string(response)
+		resp = &str
+	}
+	_, err := ledger.Exec(
+		"INSERT INTO actions (run_id, team_id, action, detail, request, response, error, time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		currentRunID(), teamID, action, detail, req, resp, nullError(actionErr), time.Now().UTC(),
+	)
+	if err != nil {
+		logError(err, "step", stepLedger)
+	}
+}
+
+// Errors can't be reported through logError here without recursing
+func recordError(errMsg error) {
+	if ledger == nil {
+		return
+	}
+	_, err := ledger.Exec(
+		"INSERT INTO errors (run_id, message, time) VALUES (?, ?, ?)",
+		currentRunID(), errMsg.Error(), time.Now().UTC(),
+	)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func recordClosure(closure Closure) error {
+	_, err := ledger.Exec(
+		`INSERT INTO closures (run_id, team_id, closed_at, terminating_at, prev_closed_at, prev_terminating_at, last_update)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		closure.RunID,
+		closure.TeamID,
+		closure.ClosedAt,
+		closure.TerminatingAt,
+		nullTime(closure.PrevClosedAt),
+		nullTime(closure.PrevTerminatingAt),
+		closure.LastUpdate,
+	)
+	return err
+}
+
+// Key used to compare last commits; teams with empty repositories share the empty key
+func lastCommitKey(lastUpdate *time.Time) string {
+	if lastUpdate == nil {
+		return ""
+	}
+	return lastUpdate.UTC().Format(time.RFC3339)
+}
+
+// Check whether an action was already applied to a team on the same day, or, if sameCommit is set, for the
+// same last commit on any day
+func isApplied(teamID int, action, day string, lastUpdate *time.Time, sameCommit bool) (bool, error) {
+	query := "SELECT COUNT(*) FROM applied WHERE team_id = ? AND action = ? AND (day = ?"
+	args := []interface{}{teamID, action, day}
+	if sameCommit {
+		query += " OR last_commit = ?"
+		args = append(args, lastCommitKey(lastUpdate))
+	}
+	var count int
+	err := ledger.QueryRow(query+")", args...).Scan(&count)
+	return count > 0, err
+}
+
+func markApplied(teamID int, action, day string, lastUpdate *time.Time) error {
+	_, err := ledger.Exec(
+		"INSERT OR REPLACE INTO applied (team_id, action, day, last_commit, run_id) VALUES (?, ?, ?, ?, ?)",
+		teamID, action, day, lastCommitKey(lastUpdate), currentRunID(),
+	)
+	return err
+}
+
+// Return closures that haven't been reverted yet, most recent first
+func getOpenClosures(teamID int, run string) ([]Closure, error) {
+	query := `SELECT id, run_id, team_id, closed_at, terminating_at, prev_closed_at, prev_terminating_at, last_update
+		FROM closures WHERE reopened_at IS NULL`
+	var args []interface{}
+	if teamID != 0 {
+		query += " AND team_id = ?"
+		args = append(args, teamID)
+	}
+	if run != "" {
+		query += " AND run_id = ?"
+		args = append(args, run)
+	}
+	rows, err := ledger.Query(query+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var closures []Closure
+	for rows.Next() {
+		var closure Closure
+		var prevClosedAt, prevTerminatingAt, lastUpdate sql.NullTime
+		err := rows.Scan(
+			&closure.ID,
+			&closure.RunID,
+			&closure.TeamID,
+			&closure.ClosedAt,
+			&closure.TerminatingAt,
+			&prevClosedAt,
+			&prevTerminatingAt,
+			&lastUpdate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		closure.PrevClosedAt = prevClosedAt.Time
+		closure.PrevTerminatingAt = prevTerminatingAt.Time
+		if lastUpdate.Valid {
+			closure.LastUpdate = &lastUpdate.Time
+		}
+		closures = append(closures, closure)
+	}
+	return closures, rows.Err()
+}
+
+// Most recent time a closure of the team was reverted, or nil if none was
+// The column is read directly because aggregates like MAX have no declared type, and the driver returns them as strings
+func getLastReopen(teamID int) (*time.Time, error) {
+	var reopenedAt time.Time
+	err := ledger.QueryRow(
+		`SELECT reopened_at FROM closures WHERE team_id = ? AND reopened_at IS NOT NULL
+		ORDER BY reopened_at DESC LIMIT 1`,
+		teamID,
+	).Scan(&reopenedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &reopenedAt, nil
+}
+
+func markReopened(closure *Closure) error {
+	_, err := ledger.Exec("UPDATE closures SET reopened_at = ? WHERE id = ?", closure.ReopenedAt, closure.ID)
+	return err
+}
+
+func getRunErrors(run string) ([]string, error) {
+	rows, err := ledger.Query("SELECT message FROM errors WHERE run_id = ? ORDER BY id", run)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []string
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// ID of the most recent run of a command that finished, or "" if there is none
+func getLastRunID(command string) (string, error) {
+	var id string
+	err := ledger.QueryRow(
+		"SELECT id FROM runs WHERE command = ? AND finished_at IS NOT NULL ORDER BY started_at DESC LIMIT 1",
+		command,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+// Checks made during a run, along with how many times each team was warned and closed over all runs
+func getRunChecks(run string) ([]DashboardTeam, error) {
+	rows, err := ledger.Query(
+		`SELECT c.team_id, c.project_id, IFNULL(c.cursus_id, 0), c.logins, c.status, c.last_commit, c.expires_at,
+			c.vacation_days, IFNULL(c.error, ''),
+			(SELECT COUNT(*) FROM applied a WHERE a.team_id = c.team_id AND a.action LIKE ?),
+			(SELECT COUNT(*) FROM closures l WHERE l.team_id = c.team_id)
+		FROM checks c WHERE c.run_id = ?
+		ORDER BY c.expires_at IS NULL, c.expires_at, c.team_id`,
+		warningEmail+":%", run,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var teams []DashboardTeam
+	for rows.Next() {
+		var team DashboardTeam
+		var logins string
+		var lastCommit, expiresAt sql.NullTime
+		err := rows.Scan(
+			&team.TeamID,
+			&team.ProjectID,
+			&team.CursusID,
+			&logins,
+			&team.Status,
+			&lastCommit,
+			&expiresAt,
+			&team.VacationDays,
+			&team.Error,
+			&team.Warnings,
+			&team.Closures,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if logins != "" {
+			team.Logins = strings.Split(logins, ",")
+		}
+		if lastCommit.Valid {
+			team.LastCommit = &lastCommit.Time
+		}
+		if expiresAt.Valid {
+			team.ExpiresAt = &expiresAt.Time
+		}
+		teams = append(teams, team)
+	}
+	return teams, rows.Err()
+}
+
+// Cursus a team was last checked through, or 0 if it was never checked
+func getLastCheckCursus(teamID int) (int, error) {
+	var cursusID int
+	err := ledger.QueryRow(
+		"SELECT cursus_id FROM checks WHERE team_id = ? AND cursus_id IS NOT NULL ORDER BY id DESC LIMIT 1",
+		teamID,
+	).Scan(&cursusID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return cursusID, err
+}
+
+func recordExemption(exemption *Exemption) (int, error) {
+	var teamID, projectID *int
+	var login *string
+	if exemption.TeamID != 0 {
+		teamID = &exemption.TeamID
+	}
+	if exemption.Login != "" {
+		login = &exemption.Login
+	}
+	if exemption.ProjectID != 0 {
+		projectID = &exemption.ProjectID
+	}
+	res, err := ledger.Exec(
+		`INSERT INTO exemptions (team_id, login, project_id, reason, expires_at, author, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		teamID, login, projectID, exemption.Reason, exemption.ExpiresAt, exemption.Author, exemption.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// Return exemptions in the order they were added; only those currently in effect unless all is set
+func getExemptions(all bool) ([]Exemption, error) {
+	query := `SELECT id, IFNULL(team_id, 0), IFNULL(login, ''), IFNULL(project_id, 0), reason, expires_at, author,
+		created_at, removed_at FROM exemptions`
+	var args []interface{}
+	if !all {
+		query += " WHERE removed_at IS NULL AND (expires_at IS NULL OR expires_at > ?)"
+		args = append(args, time.Now().UTC())
+	}
+	rows, err := ledger.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var exemptions []Exemption
+	for rows.Next() {
+		var exemption Exemption
+		var expiresAt, removedAt sql.NullTime
+		err := rows.Scan(
+			&exemption.ID,
+			&exemption.TeamID,
+			&exemption.Login,
+			&exemption.ProjectID,
+			&exemption.Reason,
+			&expiresAt,
+			&exemption.Author,
+			&exemption.CreatedAt,
+			&removedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			exemption.ExpiresAt = &expiresAt.Time
+		}
+		if removedAt.Valid {
+			exemption.RemovedAt = &removedAt.Time
+		}
+		exemptions = append(exemptions, exemption)
+	}
+	return exemptions, rows.Err()
+}
+
+// Exemptions are kept once removed, so that past decisions can still be explained
+func removeExemption(id int) (bool, error) {
+	res, err := ledger.Exec(
+		"UPDATE exemptions SET removed_at = ?, removed_by = ? WHERE id = ? AND removed_at IS NULL",
+		time.Now().UTC(), currentUser(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Check or action recorded for a team
+type HistoryEntry struct {
+	Time         time.Time
+	RunID        string
+	Kind         string
+	Detail       string
+	LastCommit   *time.Time
+	VacationDays float64
+	Error        string
+}
+
+// Return every check and action recorded for a team, oldest first
+func getTeamHistory(teamID int) ([]HistoryEntry, error) {
+	rows, err := ledger.Query(
+		`SELECT checked_at, run_id, 'check', status, last_commit, vacation_days, IFNULL(error, '')
+		FROM checks WHERE team_id = ?
+		UNION ALL
+		SELECT time, run_id, action, detail, NULL, 0, IFNULL(error, '')
+		FROM actions WHERE team_id = ?
+		ORDER BY 1`,
+		teamID, teamID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var history []HistoryEntry
+	for rows.Next() {
+		var entry HistoryEntry
+		var lastCommit sql.NullTime
+		err := rows.Scan(
+			&entry.Time,
+			&entry.RunID,
+			&entry.Kind,
+			&entry.Detail,
+			&lastCommit,
+			&entry.VacationDays,
+			&entry.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if lastCommit.Valid {
+			entry.LastCommit = &lastCommit.Time
+		}
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
+
+// Print every check and action recorded for a team, oldest first
+func historyCommand(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: gitcreeper history <team-id>")
+	}
+	teamID, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	history, err := getTeamHistory(teamID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range history {
+		fmt.Printf("%s %s %s %s", entry.Time.In(location).Format(logTimeFormat), entry.RunID, entry.Kind, entry.Detail)
+		if entry.Kind == "check" {
+			last := "Never"
+			if entry.LastCommit != nil {
+				last = entry.LastCommit.In(location).Format(time.RFC1123)
+			}
+			fmt.Printf(" [Last update: %s + %.1f vacation days]", last, entry.VacationDays)
+		}
+		if entry.Error != "" {
+			fmt.Printf(" ERROR: %s", entry.Error)
+		}
+		fmt.Println()
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestLedger(t *testing.T) {
+	t.Helper()
+	if err := openLedger(filepath.Join(t.TempDir(), "gitcreeper.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeLedger()
+		ledger = nil
+	})
+}
+
+func TestGetLastReopen(t *testing.T) {
+	openTestLedger(t)
+	reopenedAt, err := getLastReopen(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopenedAt != nil {
+		t.Fatalf("never reopened team reopened at %s", reopenedAt)
+	}
+
+	closedAt := time.Date(2024, 3, 1, 3, 0, 0, 0, time.UTC)
+	lastUpdate := closedAt.AddDate(0, 0, -14)
+	for i := 0; i < 2; i++ {
+		err := recordClosure(Closure{
+			RunID:         "run",
+			TeamID:        42,
+			ClosedAt:      closedAt.AddDate(0, 0, i),
+			TerminatingAt: closedAt.AddDate(0, 0, i),
+			LastUpdate:    &lastUpdate,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Closed but not reopened yet
+	if reopenedAt, err = getLastReopen(42); err != nil || reopenedAt != nil {
+		t.Fatalf("got %v, %v before reopening", reopenedAt, err)
+	}
+
+	closures, err := getOpenClosures(42, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closures) != 2 {
+		t.Fatalf("got %d open closures, want 2", len(closures))
+	}
+	// Closures come newest first; reopen the older one later, so that the latest time isn't in the latest row
+	want := closedAt.Add(36 * time.Hour)
+	reopenTimes := []time.Time{want.Add(-time.Hour), want}
+	for i := range closures {
+		closures[i].ReopenedAt = &reopenTimes[i]
+		if err := markReopened(&closures[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopenedAt, err = getLastReopen(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopenedAt == nil || !reopenedAt.Equal(want) {
+		t.Errorf("reopened at %v, want %s", reopenedAt, want)
+	}
+	if reopenedAt, err = getLastReopen(43); err != nil || reopenedAt != nil {
+		t.Errorf("got %v, %v for another team", reopenedAt, err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+const defaultLanguage = "en"
+
+// Words and formats needed to render dates and durations in a language
+type Locale struct {
+	Months   [12]string
+	Weekdays [7]string
+	// Arguments: weekday, day, month, year, clock
+	DateFormat string
+	NeverDate  string
+	Never      string
+	AgoFormat  string
+	Day        [2]string
+	Hour       [2]string
+	// French treats zero as singular
+	ZeroSingular bool
+}
+
+var (
+	locales = map[string]*Locale{
+		"en": {
+			Months: [12]string{"January", "February", "March", "April", "May", "June", "July", "August",
+				"September", "October", "November", "December"},
+			Weekdays:   [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+			DateFormat: "%[1]s, %[3]s %[2]d, %[4]d %[5]s",
+			NeverDate:  "NEVER",
+			Never:      "never",
+			AgoFormat:  "%s ago",
+			Day:        [2]string{"day", "days"},
+			Hour:       [2]string{"hour", "hours"},
+		},
+		"fr": {
+			Months: [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août",
+				"septembre", "octobre", "novembre", "décembre"},
+			Weekdays:     [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+			DateFormat:   "%[1]s %[2]d %[3]s %[4]d à %[5]s",
+			NeverDate:    "JAMAIS",
+			Never:        "jamais",
+			AgoFormat:    "il y a %s",
+			Day:          [2]string{"jour", "jours"},
+			Hour:         [2]string{"heure", "heures"},
+			ZeroSingular: true,
+		},
+		"es": {
+			Months: [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto",
+				"septiembre", "octubre", "noviembre", "diciembre"},
+			Weekdays:   [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+			DateFormat: "%[1]s, %[2]d de %[3]s de %[4]d, %[5]s",
+			NeverDate:  "NUNCA",
+			Never:      "nunca",
+			AgoFormat:  "hace %s",
+			Day:        [2]string{"día", "días"},
+			Hour:       [2]string{"hora", "horas"},
+		},
+	}
+	// Language identifiers by Intra language ID
+	intraLanguages map[int]string
+	userLanguages  = make(map[string]string)
+	// Guards both maps, which the daemon's status page shares with runs
+	languagesMu sync.Mutex
+)
+
+func getLocale(lang string) *Locale {
+	if locale, present := locales[lang]; present {
+		return locale
+	}
+	return locales[defaultLanguage]
+}
+
+func (locale *Locale) Date(t time.Time) string {
+	t = t.In(location)
+	return fmt.Sprintf(
+		locale.DateFormat,
+		locale.Weekdays[t.Weekday()],
+		t.Day(),
+		locale.Months[t.Month()-1],
+		t.Year(),
+		t.Format("15:04 MST"),
+	)
+}
+
+func (locale *Locale) DateOrNever(t *time.Time) string {
+	if t == nil {
+		return locale.NeverDate
+	}
+	return locale.Date(*t)
+}
+
+func (locale *Locale) Plural(n int, singular, plural string) string {
+	if n == 1 || (n == 0 && locale.ZeroSingular) {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
+// Whole days are preferred over hours, except for the last day
+func (locale *Locale) Duration(d time.Duration) string {
+	hours := int(d.Hours())
+	if hours%24 != 0 || hours == 24 {
+		return locale.Plural(hours, locale.Hour[0], locale.Hour[1])
+	}
+	return locale.Plural(hours/24, locale.Day[0], locale.Day[1])
+}
+
+func (locale *Locale) Elapsed(last *time.Time) string {
+	if last == nil {
+		return locale.Never
+	}
+	days := int(time.Now().UTC().Sub(*last).Hours() / 24)
+	return fmt.Sprintf(locale.AgoFormat, locale.Plural(days, locale.Day[0], locale.Day[1]))
+}
+
+// Functions available to every template, rendering in the email's language
+func templateFuncs(lang string) template.FuncMap {
+	locale := getLocale(lang)
+	return template.FuncMap{
+		"date":     locale.DateOrNever,
+		"datetime": locale.Date,
+		"plural":   locale.Plural,
+		"duration": locale.Duration,
+		"join":     strings.Join,
+	}
+}
+
+func isSupportedLanguage(lang string) bool {
+	return lang == config.DefaultLanguage || containsString(config.Languages, lang)
+}
+
+func loadIntraLanguages() error {
+	languages := &intra.Languages{}
+	if err := languages.GetAllLanguages(context.Background(), url.Values{}); err != nil {
+		return err
+	}
+	intraLanguages = make(map[int]string)
+	for _, language := range *languages {
+		intraLanguages[language.ID] = strings.ToLower(language.Identifier)
+	}
+	return nil
+}
+
+// Return the student's preferred language on Intra if there are templates for it, or the default language
+func getUserLanguage(login string) string {
+	if len(config.Languages) == 0 {
+		return config.DefaultLanguage
+	}
+	languagesMu.Lock()
+	defer languagesMu.Unlock()
+	if lang, present := userLanguages[login]; present {
+		return lang
+	}
+	lang := config.DefaultLanguage
+	user := &intra.User{}
+	err := user.GetUser(context.Background(), false, login)
+	if err == nil && intraLanguages == nil {
+		err = loadIntraLanguages()
+	}
+	if err != nil {
+		logError(err, "step", stepIntra, "login", login)
+		return lang
+	}
+	// Lower positions are preferred
+	var preferred *intra.LanguagesUser
+	for i, lu := range user.LanguagesUsers {
+		if isSupportedLanguage(intraLanguages[lu.LanguageID]) && (preferred == nil || lu.Position < preferred.Position) {
+			preferred = &user.LanguagesUsers[i]
+		}
+	}
+	if preferred != nil {
+		lang = intraLanguages[preferred.LanguageID]
+	}
+	userLanguages[login] = lang
+	return lang
+}
+
+// Shared emails are only localized when every member prefers the same language
+func getTeamLanguage(team *intra.Team) string {
+	lang := ""
+	for _, user := range team.Users {
+		userLang := getUserLanguage(user.Login)
+		if lang != "" && userLang != lang {
+			return config.DefaultLanguage
+		}
+		lang = userLang
+	}
+	if lang == "" {
+		return config.DefaultLanguage
+	}
+	return lang
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// RFC 5322 message with a plain text part and an HTML alternative
+type Message struct {
+	From      string
+	To        []string
+	Subject   string
+	Date      time.Time
+	MessageID string
+	Text      string
+	HTML      string
+}
+
+func newMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at != -1 {
+		domain = from[at+1:]
+	}
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(), hex.EncodeToString(buf), domain)
+}
+
+// RFC 2047 limits lines containing encoded-words to 76 characters
+const (
+	maxHeaderLine  = 76
+	maxEncodedWord = maxHeaderLine - len("Subject: ")
+)
+
+func formatAddresses(addresses []string) []string {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = (&mail.Address{Address: address}).String()
+	}
+	return formatted
+}
+
+// Join tokens with sep, folding before a token whenever the line would get too long
+// Folding replaces the separator's trailing space with CRLF SP, so unfolding restores the original value
+func foldHeader(key string, tokens []string, sep string) string {
+	folded := &strings.Builder{}
+	folded.WriteString(key + ":")
+	lineLen := folded.Len()
+	for i, token := range tokens {
+		if i > 0 && lineLen+len(sep)+len(token) > maxHeaderLine {
+			folded.WriteString(strings.TrimRight(sep, " ") + "\r\n ")
+			lineLen = 1
+		} else if i == 0 {
+			folded.WriteString(" ")
+			lineLen++
+		} else {
+			folded.WriteString(sep)
+			lineLen += len(sep)
+		}
+		folded.WriteString(token)
+		lineLen += len(token)
+	}
+	return folded.String()
+}
+
+func needsEncoding(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x7f || (s[i] < ' ' && s[i] != '\t') {
+			return true
+		}
+	}
+	return strings.Contains(s, "=?")
+}
+
+// Split s into Q encoded-words short enough to fit on a header line; whitespace between encoded-words is ignored
+// when decoding, so spaces are encoded within them
+func encodeWords(s string) []string {
+	const prefix, suffix = "=?UTF-8?q?", "?="
+	var words []string
+	word := &strings.Builder{}
+	for _, r := range s {
+		enc := &strings.Builder{}
+		buf := make([]byte, utf8.UTFMax)
+		for _, b := range buf[:utf8.EncodeRune(buf, r)] {
+			switch {
+			case b == ' ':
+				enc.WriteByte('_')
+			case b > ' ' && b < 0x7f && b != '=' && b != '?' && b != '_':
+				enc.WriteByte(b)
+			default:
+				_, _ = fmt.Fprintf(enc, "=%02X", b)
+			}
+		}
+		if word.Len() > 0 && len(prefix)+word.Len()+enc.Len()+len(suffix) > maxEncodedWord {
+			words = append(words, prefix+word.String()+suffix)
+			word.Reset()
+		}
+		word.WriteString(enc.String())
+	}
+	if word.Len() > 0 {
+		words = append(words, prefix+word.String()+suffix)
+	}
+	return words
+}
+
+func formatSubject(subject string) string {
+	if needsEncoding(subject) {
+		return foldHeader("Subject", encodeWords(subject), " ")
+	}
+	return foldHeader("Subject", strings.Split(subject, " "), " ")
+}
+
+func writePart(mw *multipart.Writer, contentType, content string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=UTF-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Render the message with CRLF line endings, ready to be handed to an SMTP server
+func (msg *Message) Bytes() ([]byte, error) {
+	if msg.Date.IsZero() {
+		msg.Date = time.Now().In(location)
+	}
+	if msg.MessageID == "" {
+		msg.MessageID = newMessageID(msg.From)
+	}
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	if err := writePart(mw, "text/plain", msg.Text); err != nil {
+		return nil, err
+	}
+	if err := writePart(mw, "text/html", msg.HTML); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	headers := []string{
+		"From: " + (&mail.Address{Address: msg.From}).String(),
+		foldHeader("To", formatAddresses(msg.To), ", "),
+		formatSubject(msg.Subject),
+		"Date: " + msg.Date.Format(time.RFC1123Z),
+		"Message-ID: " + msg.MessageID,
+		"MIME-Version: 1.0",
+		foldHeader("Content-Type", strings.Split(
+			mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}), "; "), "; "),
+	}
+	out := &bytes.Buffer{}
+	for _, header := range headers {
+		out.WriteString(header + "\r\n")
+	}
+	out.WriteString("\r\n")
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
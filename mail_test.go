@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var messageIDPattern = regexp.MustCompile(`^<[^<>@\s]+@[^<>@\s]+>$`)
+
+func testMessage(subject string, to ...string) *Message {
+	return &Message{
+		From:    "noreply@42.us.org",
+		To:      to,
+		Subject: subject,
+		Text:    "Ton dernier commit date d’il y a 12 jours.\nCheck how much time you have left: " + strings.Repeat("x", 120),
+		HTML:    "<p>Ton dernier commit date d’il y a <b>12 jours</b>.</p>",
+	}
+}
+
+// Parse a rendered message, checking the constraints mail-lint tools check on the raw bytes
+func lintMessage(t *testing.T, msg *Message) *mail.Message {
+	t.Helper()
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		t.Fatal("no blank line after the header")
+	}
+	for i, line := range strings.Split(string(data), "\r\n") {
+		if strings.Contains(line, "\n") || strings.Contains(line, "\r") {
+			t.Errorf("line %d has a bare CR or LF: %q", i+1, line)
+		}
+		if len(line) > 998 {
+			t.Errorf("line %d is %d characters long", i+1, len(line))
+		}
+	}
+	for i, line := range strings.Split(string(data[:headerEnd]), "\r\n") {
+		if len(line) > maxHeaderLine {
+			t.Errorf("header line %d is %d characters long: %q", i+1, len(line), line)
+		}
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestMessageHeaders(t *testing.T) {
+	subjects := []string{
+		"libft Nearing Update Deadline",
+		"[PROJECT] ft_transcendence approche de la date limite de mise à jour, vérifie ton dépôt dès que possible",
+		"[PROJECT] ft_transcendence se acerca a la fecha límite de actualización: revisa tu repositorio cuanto antes",
+		strings.Repeat("Plain ASCII subject long enough to need folding ", 3),
+		"Literal =?UTF-8?q?encoded-word?= lookalike",
+	}
+	to := []string{
+		"alogin@student.42.us.org",
+		"anotherlogin@student.42.us.org",
+		"yetanotherlogin@student.42.us.org",
+		"lastlogin@student.42.us.org",
+	}
+	decoder := &mime.WordDecoder{}
+	for _, subject := range subjects {
+		msg := testMessage(subject, to...)
+		parsed := lintMessage(t, msg)
+		decoded, err := decoder.DecodeHeader(parsed.Header.Get("Subject"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != subject {
+			t.Errorf("subject decoded as %q, want %q", decoded, subject)
+		}
+		addresses, err := parsed.Header.AddressList("To")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addresses) != len(to) {
+			t.Fatalf("got %d recipients, want %d", len(addresses), len(to))
+		}
+		for i, address := range addresses {
+			if address.Address != to[i] {
+				t.Errorf("recipient %d is %s, want %s", i, address.Address, to[i])
+			}
+		}
+		date, err := parsed.Header.Date()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(date) > time.Minute || time.Until(date) > time.Minute {
+			t.Errorf("date %s is not the current time", date)
+		}
+		if id := parsed.Header.Get("Message-ID"); !messageIDPattern.MatchString(id) {
+			t.Errorf("invalid Message-ID %q", id)
+		}
+		if !strings.HasSuffix(parsed.Header.Get("Message-ID"), "@42.us.org>") {
+			t.Errorf("Message-ID %q is not on the sender's domain", parsed.Header.Get("Message-ID"))
+		}
+		if parsed.Header.Get("MIME-Version") != "1.0" {
+			t.Errorf("MIME-Version is %q", parsed.Header.Get("MIME-Version"))
+		}
+	}
+}
+
+func TestMessageParts(t *testing.T) {
+	msg := testMessage("libft Nearing Update Deadline", "alogin@student.42.us.org")
+	parsed := lintMessage(t, msg)
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("content type is %s", mediaType)
+	}
+	// Plain text first, so that clients prefer the HTML alternative
+	want := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain", msg.Text},
+		{"text/html", msg.HTML},
+	}
+	mr := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		partType, partParams, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partType != w.contentType || !strings.EqualFold(partParams["charset"], "UTF-8") {
+			t.Errorf("part is %s; charset=%s, want %s; charset=UTF-8", partType, partParams["charset"], w.contentType)
+		}
+		// The quoted-printable encoding is removed by the reader, and text is canonicalized to CRLF line endings
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.ReplaceAll(string(content), "\r\n", "\n") != w.content {
+			t.Errorf("%s part is %q, want %q", w.contentType, content, w.content)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected exactly two parts, got error %v", err)
+	}
+}
+
+func TestMessageKeepsDateAndID(t *testing.T) {
+	msg := testMessage("libft Nearing Update Deadline", "alogin@student.42.us.org")
+	msg.Date = time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	msg.MessageID = "<retry.1@42.us.org>"
+	parsed := lintMessage(t, msg)
+	date, err := parsed.Header.Date()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !date.Equal(msg.Date) {
+		t.Errorf("date is %s, want %s", date, msg.Date)
+	}
+	if id := parsed.Header.Get("Message-ID"); id != msg.MessageID {
+		t.Errorf("Message-ID is %q, want %q", id, msg.MessageID)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	smtpTransport     = "smtp"
+	sendmailTransport = "sendmail"
+	maildirTransport  = "maildir"
+	mboxTransport     = "mbox"
+	httpTransport     = "http"
+
+	defaultSendmailPath = "/usr/sbin/sendmail"
+	mailAPITimeout      = 30 * time.Second
+)
+
+// Delivers fully rendered RFC 5322 messages
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+	Close() error
+}
+
+var mailer Mailer
+
+func newMailer() (Mailer, error) {
+	switch strings.ToLower(config.MailTransport) {
+	case "", smtpTransport:
+		return &SMTPMailer{}, nil
+	case sendmailTransport:
+		path := config.SendmailPath
+		if path == "" {
+			path = defaultSendmailPath
+		}
+		return &SendmailMailer{path}, nil
+	// An empty MailboxPath would deliver into the working directory
+	case maildirTransport:
+		if config.MailboxPath == "" {
+			return nil, errors.New("MailboxPath is required by the maildir transport")
+		}
+		return &MaildirMailer{config.MailboxPath}, nil
+	case mboxTransport:
+		if config.MailboxPath == "" {
+			return nil, errors.New("MailboxPath is required by the mbox transport")
+		}
+		return &MboxMailer{config.MailboxPath}, nil
+	case httpTransport:
+		return &HTTPMailer{config.MailAPIURL, os.Getenv("MAIL_API_KEY")}, nil
+	}
+	return nil, fmt.Errorf("unsupported mail transport: %s", config.MailTransport)
+}
+
+func getMailer() (Mailer, error) {
+	if mailer != nil {
+		return mailer, nil
+	}
+	m, err := newMailer()
+	if err == nil {
+		mailer = m
+	}
+	return m, err
+}
+
+func closeMailer() {
+	if mailer == nil {
+		return
+	}
+	if err := mailer.Close(); err != nil {
+		logError(err, "step", stepEmail)
+	}
+	mailer = nil
+}
+
+// Pipes messages to a local sendmail-compatible binary
+type SendmailMailer struct {
+	path string
+}
+
+func (mailer *SendmailMailer) Send(from string, to []string, msg []byte) error {
+	cmd := exec.Command(mailer.path, append([]string{"-i", "-f", from, "--"}, to...)...)
+	cmd.Stdin = bytes.NewReader(msg)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (mailer *SendmailMailer) Close() error {
+	return nil
+}
+
+// Writes each message to its own file in a Maildir, which makes staging runs easy to inspect
+type MaildirMailer struct {
+	path string
+}
+
+func (mailer *MaildirMailer) Send(from string, to []string, msg []byte) error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(mailer.path, dir), os.FileMode(0700)); err != nil {
+			return err
+		}
+	}
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().Unix(), time.Now().UnixNano(), os.Getpid(), hostname)
+	tmp := filepath.Join(mailer.path, "tmp", name)
+	if err := ioutil.WriteFile(tmp, msg, os.FileMode(0600)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(mailer.path, "new", name))
+}
+
+func (mailer *MaildirMailer) Close() error {
+	return nil
+}
+
+// Appends messages to a single mbox file
+type MboxMailer struct {
+	path string
+}
+
+func (mailer *MboxMailer) Send(from string, to []string, msg []byte) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From %s %s\n", from, time.Now().UTC().Format(time.ANSIC))
+	for _, line := range strings.Split(strings.ReplaceAll(string(msg), "\r\n", "\n"), "\n") {
+		// mboxrd quoting, so that body lines are never mistaken for a message separator
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString("\n")
+	f, err := os.OpenFile(mailer.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (mailer *MboxMailer) Close() error {
+	return nil
+}
+
+// Posts messages as JSON to an HTTP mail API in the style of SendGrid or Mailgun
+type HTTPMailer struct {
+	endpoint string
+	apiKey   string
+}
+
+var mailAPIClient = &http.Client{Timeout: mailAPITimeout}
+
+type HTTPMail struct {
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Text    string   `json:"text"`
+	HTML    string   `json:"html"`
+}
+
+// Split a rendered message back into the fields expected by HTTP mail APIs
+func parseMessage(msg []byte) (*HTTPMail, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	res := &HTTPMail{}
+	if res.Subject, err = (&mime.WordDecoder{}).DecodeHeader(parsed.Header.Get("Subject")); err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		body, err := ioutil.ReadAll(parsed.Body)
+		res.Text = string(body)
+		return res, err
+	}
+	mr := multipart.NewReader(parsed.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		switch partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); partType {
+		case "text/plain":
+			res.Text = string(content)
+		case "text/html":
+			res.HTML = string(content)
+		}
+	}
+	return res, nil
+}
+
+func (mailer *HTTPMailer) Send(from string, to []string, msg []byte) error {
+	if mailer.endpoint == "" {
+		return errors.New("MailAPIURL is not configured")
+	}
+	payload, err := parseMessage(msg)
+	if err != nil {
+		return err
+	}
+	payload.From = from
+	payload.To = to
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, mailer.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if mailer.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+mailer.apiKey)
+	}
+	resp, err := mailAPIClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Mail API error [Response: %d] %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (mailer *HTTPMailer) Close() error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPMailerSend(t *testing.T) {
+	var received HTTPMail
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type is %q", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	// A subject long enough to be folded over several encoded-words
+	msg := testMessage("[PROJECT] ft_transcendence approche de la date limite de mise à jour, vérifie ton dépôt",
+		"alogin@student.42.us.org", "anotherlogin@student.42.us.org")
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer := &HTTPMailer{server.URL, "secret"}
+	if err := mailer.Send(msg.From, msg.To, data); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("Authorization is %q", auth)
+	}
+	if received.From != msg.From {
+		t.Errorf("from is %q, want %q", received.From, msg.From)
+	}
+	if strings.Join(received.To, ",") != strings.Join(msg.To, ",") {
+		t.Errorf("to is %v, want %v", received.To, msg.To)
+	}
+	if received.Subject != msg.Subject {
+		t.Errorf("subject is %q, want %q", received.Subject, msg.Subject)
+	}
+	if strings.ReplaceAll(received.Text, "\r\n", "\n") != msg.Text {
+		t.Errorf("text is %q, want %q", received.Text, msg.Text)
+	}
+	if received.HTML != msg.HTML {
+		t.Errorf("html is %q, want %q", received.HTML, msg.HTML)
+	}
+}
+
+func TestHTTPMailerSendError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid recipient", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	msg := testMessage("libft Nearing Update Deadline", "alogin@student.42.us.org")
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&HTTPMailer{server.URL, ""}).Send(msg.From, msg.To, data)
+	if err == nil || !strings.Contains(err.Error(), "invalid recipient") {
+		t.Errorf("expected the API error, got %v", err)
+	}
+	if err := (&HTTPMailer{"", ""}).Send(msg.From, msg.To, data); err == nil {
+		t.Error("expected an error without MailAPIURL")
+	}
+}
+
+func TestParseMessagePlainText(t *testing.T) {
+	res, err := parseMessage([]byte("From: noreply@42.us.org\r\nSubject: =?UTF-8?q?d=C3=A9p=C3=B4t?=\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\nHello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Subject != "dépôt" || res.Text != "Hello" || res.HTML != "" {
+		t.Errorf("parsed %+v", res)
+	}
+}
+
+func TestNewMailerRequiresMailboxPath(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	for _, transport := range []string{maildirTransport, mboxTransport} {
+		config.MailTransport = transport
+		config.MailboxPath = ""
+		if _, err := newMailer(); err == nil {
+			t.Errorf("%s: expected an error without MailboxPath", transport)
+		}
+		config.MailboxPath = t.TempDir()
+		if _, err := newMailer(); err != nil {
+			t.Errorf("%s: %v", transport, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMailSpoolPath   = ".mail_spool"
+	defaultMailMaxAttempts = 10
+	mailRetryBase          = time.Minute
+	mailRetryMax           = 12 * time.Hour
+)
+
+// Outgoing messages are spooled to disk before delivery so that SMTP failures never lose a notice
+type QueuedMail struct {
+	ID            string
+	TeamID        int
+	Type          string
+	From          string
+	To            []string
+	Body          []byte
+	CreatedAt     time.Time
+	Attempts      int
+	NextAttempt   time.Time
+	LastError     string
+	Undeliverable bool
+}
+
+func (m *QueuedMail) path() string {
+	return filepath.Join(config.MailSpoolPath, m.ID+".json")
+}
+
+// Write to a temporary file first so that a crash never leaves a truncated message in the spool
+func (m *QueuedMail) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := m.path() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, os.FileMode(0600)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path())
+}
+
+func (m *QueuedMail) remove() error {
+	return os.Remove(m.path())
+}
+
+func enqueueMail(m *QueuedMail) error {
+	if err := os.MkdirAll(config.MailSpoolPath, os.FileMode(0700)); err != nil {
+		return err
+	}
+	m.CreatedAt = time.Now().UTC()
+	m.NextAttempt = m.CreatedAt
+	m.ID = fmt.Sprintf("%s-%d-%s", m.CreatedAt.Format("20060102-150405.000000000"), m.TeamID, m.Type)
+	return m.save()
+}
+
+func loadMailQueue() ([]*QueuedMail, error) {
+	paths, err := filepath.Glob(filepath.Join(config.MailSpoolPath, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	queue := make([]*QueuedMail, 0, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		m := &QueuedMail{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		queue = append(queue, m)
+	}
+	return queue, nil
+}
+
+func mailRetryDelay(attempts int) time.Duration {
+	delay := mailRetryBase
+	for i := 1; i < attempts && delay < mailRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > mailRetryMax {
+		delay = mailRetryMax
+	}
+	return delay
+}
+
+// Attempt delivery; on failure the message stays spooled with an exponentially increasing delay
+func deliverMail(m *QueuedMail) error {
+	transport, err := getMailer()
+	if err == nil {
+		err = transport.Send(m.From, m.To, m.Body)
+	}
+	recordAction("email", m.TeamID, fmt.Sprintf("%s email to %s", m.Type, strings.Join(m.To, ",")), nil, nil, err)
+	if err == nil {
+		metricEmails.Inc(m.Type, "sent")
+		return m.remove()
+	}
+	metricEmails.Inc(m.Type, "failed")
+	m.Attempts++
+	m.LastError = err.Error()
+	m.NextAttempt = time.Now().UTC().Add(mailRetryDelay(m.Attempts))
+	m.Undeliverable = m.Attempts >= config.MailMaxAttempts
+	if saveErr := m.save(); saveErr != nil {
+		logError(saveErr, "step", stepEmail, "mail_id", m.ID)
+	}
+	return err
+}
+
+// Deliver spooled messages that are due, or all pending messages if forced
+func flushMailQueue(force bool) (delivered, failed int, err error) {
+	queue, err := loadMailQueue()
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now().UTC()
+	for _, m := range queue {
+		if m.Undeliverable || (!force && m.NextAttempt.Sub(now) > 0) {
+			continue
+		}
+		if err := deliverMail(m); err != nil {
+			failed++
+			continue
+		}
+		delivered++
+	}
+	return delivered, failed, nil
+}
+
+// Surface messages that have exhausted their retries so that staff can follow up by hand
+func logUndeliverable() []UndeliverableMail {
+	undeliverable := []UndeliverableMail{}
+	queue, err := loadMailQueue()
+	if err != nil {
+		logError(err, "step", stepEmail)
+		return undeliverable
+	}
+	for _, m := range queue {
+		if m.Undeliverable {
+			undeliverable = append(undeliverable, UndeliverableMail{
+				ID:        m.ID,
+				TeamID:    m.TeamID,
+				Type:      m.Type,
+				To:        m.To,
+				Attempts:  m.Attempts,
+				LastError: m.LastError,
+			})
+			logger.Warn("Undeliverable email",
+				"mail_id", m.ID,
+				"team_id", m.TeamID,
+				"type", m.Type,
+				"to", strings.Join(m.To, ","),
+				"error", m.LastError,
+			)
+		}
+	}
+	return undeliverable
+}
+
+func mailCommand(args []string) error {
+	usage := errors.New("usage: gitcreeper mail queue | flush | drop (<id>... | --all)")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "queue":
+		queue, err := loadMailQueue()
+		if err != nil {
+			return err
+		}
+		for _, m := range queue {
+			state := "retry at " + m.NextAttempt.In(location).Format(logTimeFormat)
+			if m.Undeliverable {
+				state = "UNDELIVERABLE"
+			}
+			fmt.Printf("%s <%d> %s %s %d attempts, %s %s\n",
+				m.ID, m.TeamID, m.Type, strings.Join(m.To, ","), m.Attempts, state, m.LastError)
+		}
+		fmt.Printf("%d messages queued.\n", len(queue))
+	case "flush":
+		// A run flushes the spool too, and the same message must not be delivered twice
+		unlock, err := acquireRunLock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		delivered, failed, err := flushMailQueue(true)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d messages delivered, %d failed.\n", delivered, failed)
+	case "drop":
+		fs := flag.NewFlagSet("drop", flag.ExitOnError)
+		all := fs.Bool("all", false, "drop every queued message")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if !*all && fs.NArg() == 0 {
+			return usage
+		}
+		unlock, err := acquireRunLock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		queue, err := loadMailQueue()
+		if err != nil {
+			return err
+		}
+		ids := make(map[string]bool)
+		for _, ID := range fs.Args() {
+			ids[ID] = true
+		}
+		dropped := 0
+		for _, m := range queue {
+			if !*all && !ids[m.ID] {
+				continue
+			}
+			if err := m.remove(); err != nil {
+				return err
+			}
+			recordAction("email_dropped", m.TeamID, fmt.Sprintf("%s email to %s", m.Type, strings.Join(m.To, ",")), nil, nil, nil)
+			dropped++
+		}
+		fmt.Printf("%d messages dropped.\n", dropped)
+	default:
+		return usage
+	}
+	return nil
+}
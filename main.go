@@ -2,64 +2,172 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata"
 
 	"gitcreeper/intra"
 
 	"github.com/getsentry/sentry-go"
 )
 
+type WarningStage struct {
+	HoursBefore float64
+	Template    string
+	// Overrides the template's subject; %s is replaced with the project name
+	Subject string
+}
+
+func (stage WarningStage) Duration() time.Duration {
+	return time.Duration(stage.HoursBefore * float64(time.Hour))
+}
+
+// Each stage is tracked separately so that it is only sent once per inactivity period
+func (stage WarningStage) Action() string {
+	return fmt.Sprintf("%s:%gh", warningEmail, stage.HoursBefore)
+}
+
 type Config struct {
 	CampusDomain         string
 	CampusID             int
 	CursusIDs            []int
 	StartClosingAt       time.Time
 	ProjectStartingRange time.Time
-	DaysUntilStagnant    int
-	DaysToCorrect        int
-	AllowVacations       bool
-	VacationsEndpoint    string
-	RepoAddress          string
-	RepoPort             int
-	RepoUser             string
-	RepoPrivateKeyPath   string
-	RepoPath             string
-	EmailServerAddress   string
-	EmailFromAddress     string
+	// IANA name of the campus timezone, e.g. America/Los_Angeles; the host's timezone if empty
+	Timezone           string
+	DaysUntilStagnant  int
+	DaysToCorrect      int
+	WarningSchedule    []WarningStage
+	Branches           []string
+	Policies           []Policy
+	AllowVacations     bool
+	VacationsEndpoint  string
+	RepoAddress        string
+	RepoPort           int
+	RepoUser           string
+	RepoPrivateKeyPath string
+	RepoPath           string
+	EmailServerAddress string
+	EmailFromAddress   string
+	EmailAuth          string
+	EmailUsername      string
+	// "tls", "starttls" or "none"; if empty, STARTTLS is used whenever the server offers it
+	EmailSecurity        string
+	EmailPerStudent      bool
+	TemplatePath         string
+	DefaultLanguage      string
+	Languages            []string
+	Branding             Branding
+	MailTransport        string
+	SendmailPath         string
+	MailboxPath          string
+	MailAPIURL           string
+	MailSpoolPath        string
+	MailMaxAttempts      int
+	StaffDigestAddresses []string
 	SlackLogging         bool
 	SlackOutputChannel   string
-	ProjectWhitelist     []int
+	SlackBaseURL         string
+	Webhooks             []Webhook
+	WebhookMaxAttempts   int
+	MetricsTextfile      string
+	SentryRelease        string
+	SentryEnvironment    string
+	// Sentry Crons monitor checked in with at the start and end of each run
+	SentryMonitorSlug     string
+	SentryMonitorSchedule string
+	LedgerPath            string
+	// Lock file preventing overlapping runs, whether started by cron or the daemon
+	LockPath string
+	// Address of the daemon's health, readiness and metrics endpoints
+	ServeAddress string
+	// Time of day, in Timezone, at which the daemon runs
+	ServeRunAt string
+	// Public address of the daemon's student status page, linked from warning emails; no link if empty
+	StatusURL string
+	// Number of days status links remain valid
+	StatusLinkDays int
+	// Projects whose teams are checked, by ID; none if empty, unless selected by slug or discovered
+	ProjectWhitelist []int
+	// Project slugs to check, as patterns such as "ft_*"
+	ProjectSlugPatterns []string
+	// Projects never checked, by ID or slug pattern
+	ProjectBlacklist      []int
+	ProjectBlacklistSlugs []string
+	// Leave out exams, and only check "solo" or "group" projects if set; whitelisted IDs are kept regardless
+	ExcludeExamProjects bool
+	ProjectTeamSize     string
+	// Check every project of ProjectCursusIDs, less those excluded by the rules above
+	DiscoverProjects bool
+	// Cursus whose projects are candidates; CursusIDs if empty
+	ProjectCursusIDs []int
 }
 
 const (
 	intraTimeFormat   = "2006-01-02T15:04:05.000Z"
 	logTimeFormat     = "2006/01/02 15:04:05"
+	runIDFormat       = "20060102-150405"
+	defaultLedgerPath = "gitcreeper.db"
+	dayFormat         = "2006-01-02"
+	closeAction       = "close"
+	cheatAction       = "cheat_suspected"
 	projectNamesCache = ".project_names"
+	projectSlugsCache = ".project_slugs"
 )
 
 var (
-	config                   Config
-	projectWhitelist         = make(map[int]bool)
-	projectNames             = make(map[int]string)
-	projectNamesCacheUpdated = false
+	config              Config
+	projectNames        = make(map[int]string)
+	projectSlugs        = make(map[int]string)
+	projectCacheUpdated = false
+	// Guards the project caches, which the daemon's request handlers share with runs
+	projectCacheMu sync.Mutex
+	// Read through currentRunID, since the daemon's request handlers may log errors while a run starts
+	runID      string
+	runIDMu    sync.RWMutex
+	configHash string
+	// Timezone in which days start and dates are shown to students and staff
+	location = time.Local
+	force    = flag.Bool("force", false, "repeat actions that were already applied today")
 )
 
+// Check if team's project is in scope and that it has a local repository
+func isEligibleTeam(team *intra.Team) bool {
+	return projectScope[team.ProjectID] && strings.Contains(team.RepoURL, config.CampusDomain)
+}
+
+func currentRunID() string {
+	runIDMu.RLock()
+	defer runIDMu.RUnlock()
+	return runID
+}
+
+func setRunID(id string) {
+	runIDMu.Lock()
+	runID = id
+	runIDMu.Unlock()
+}
+
 // Return teams that may be stagnant according to config
-func getEligibleTeams(expirationDate time.Time) (res intra.Teams) {
-	output("Getting eligible teams from 42 Intra... ")
+func getEligibleTeams(midnight time.Time) (res intra.Teams) {
+	logger.Info("Getting eligible teams from 42 Intra")
 	// Some teams may belong to more than one cursus
 	eligibleTeams := make(map[int]bool)
-	// Need to get teams one day younger than the expirationDate to send warnings to those with empty repositories
+	// Need to get teams younger than the expirationDate to send warnings to those with empty repositories
 	lockedRange := fmt.Sprintf(
 		"%s,%s",
 		config.ProjectStartingRange.Format(intraTimeFormat),
-		expirationDate.Add(24*time.Hour).Format(intraTimeFormat),
+		lockedBefore(midnight).Format(intraTimeFormat),
 	)
 	for _, cursusID := range config.CursusIDs {
 		params := url.Values{}
@@ -71,82 +179,154 @@ func getEligibleTeams(expirationDate time.Time) (res intra.Teams) {
 		params.Set("page[size]", "100")
 		teams := &intra.Teams{}
 		if err := teams.GetAllTeams(context.Background(), params); err != nil {
-			outputErr(err, false)
+			logError(err, "step", stepIntra, "cursus_id", cursusID)
 		}
-		// Check if team is on the whitelist and that it has a local repository
 		for _, team := range *teams {
-			_, present := eligibleTeams[team.ID]
-			_, whitelisted := projectWhitelist[team.ProjectID]
-			if present || !whitelisted || !strings.Contains(team.RepoURL, config.CampusDomain) {
+			if eligibleTeams[team.ID] || !isEligibleTeam(&team) {
 				continue
 			}
 			res = append(res, team)
 			eligibleTeams[team.ID] = true
+			teamCursus[team.ID] = cursusID
 		}
 	}
-	output("%d teams retrieved.\n", len(res))
+	logger.Info("Eligible teams retrieved", "teams", len(res))
 	return
 }
 
-func closeTeam(team *intra.Team, midnight time.Time) error {
+func closeTeam(team *intra.Team, lastUpdate *time.Time, midnight time.Time) error {
 	patched := *team
 	patched.ClosedAt = midnight
-	patched.TerminatingAt = patched.ClosedAt.Add(time.Duration(config.DaysToCorrect) * 24 * time.Hour)
+	patched.TerminatingAt = patched.ClosedAt.Add(time.Duration(getPolicy(team).DaysToCorrect) * 24 * time.Hour)
 	params := url.Values{}
 	params.Set("team[closed_at]", patched.ClosedAt.Format(intraTimeFormat))
 	params.Set("team[terminating_at]", patched.TerminatingAt.Format(intraTimeFormat))
-	_, _, err := patched.PatchTeam(context.Background(), true, params)
+	_, resp, err := patched.PatchTeam(context.Background(), true, params)
+	recordAction("closed", team.ID, "team closed", params, resp, err)
 	if err != nil {
 		return err
 	}
+	// Remember the previous values so that the closure can be reverted with `gitcreeper reopen`
+	err = recordClosure(Closure{
+		TeamID:            team.ID,
+		RunID:             currentRunID(),
+		ClosedAt:          patched.ClosedAt,
+		TerminatingAt:     patched.TerminatingAt,
+		PrevClosedAt:      team.ClosedAt,
+		PrevTerminatingAt: team.TerminatingAt,
+		LastUpdate:        lastUpdate,
+	})
 	*team = patched
-	return nil
+	metricClosures.Inc()
+	return err
+}
+
+// Apply an action at most once per team and day, and send warnings and cheat notices only once per last commit,
+// unless forced
+func applyOnce(team *intra.Team, action string, midnight time.Time, lastUpdate *time.Time, apply func() error) (bool, error) {
+	day := midnight.Format(dayFormat)
+	if !*force {
+		applied, err := isApplied(team.ID, action, day, lastUpdate, strings.HasPrefix(action, warningEmail+":") || action == cheatAction)
+		if err != nil || applied {
+			return false, err
+		}
+	}
+	if err := apply(); err != nil {
+		return true, err
+	}
+	return true, markApplied(team.ID, action, day, lastUpdate)
 }
 
-func processTeams(teams intra.Teams, midnight, expirationDate time.Time, prelaunch bool) {
-	output("Processing...\n\n")
-	ok, nStagnant, nWarned, nCheat := 0, 0, 0, 0
+func processTeams(teams intra.Teams, exemptions []Exemption, midnight time.Time, prelaunch bool) *RunReport {
+	logger.Info("Processing teams", "prelaunch", prelaunch, "exemptions", len(exemptions))
+	report := newRunReport(midnight, prelaunch)
 	for i := range teams {
 		team := &teams[i]
-		status, lastUpdate, err := checkStagnant(team, midnight, expirationDate)
-		switch status {
+		record := newTeamRecord(team)
+		if exemption := findExemption(exemptions, team); exemption != nil {
+			teamLogger(team).Info("Team exempt", "exemption_id", exemption.ID, "reason", exemption.Reason)
+			recordCheck(team, EXEMPT, nil, 0, nil, nil)
+			record.Status = EXEMPT
+			record.Exemption = exemption.Reason
+			report.add(record)
+			continue
+		}
+		check, err := checkStagnant(team, midnight)
+		if err != nil {
+			logError(err, "step", stepSSH, "team_id", team.ID, "project_id", team.ProjectID, "status", ERROR)
+			record.Status = ERROR
+			record.Error = err.Error()
+			report.add(record)
+			continue
+		}
+		lastUpdate := check.LastUpdate
+		record.Status = check.Status
+		record.LastCommit = lastUpdate
+		record.VacationDays = check.VacationTime.Hours() / 24.0
+		failedAction := ""
+		once := func(action string, apply func() error) error {
+			// Warnings given before a reopening don't count for the period that follows it
+			applied, err := applyOnce(team, action, midnight, check.Since, apply)
+			if err != nil {
+				failedAction = action
+			} else if !applied {
+				record.Skipped = append(record.Skipped, action)
+			} else {
+				record.Actions = append(record.Actions, action)
+			}
+			return err
+		}
+		switch check.Status {
 		case STAGNANT:
 			if prelaunch {
-				err = sendEmail(team, lastUpdate, prelaunchEmail)
-			} else if err = closeTeam(team, midnight); err == nil {
-				err = sendEmail(team, lastUpdate, closedEmail)
+				err = once(prelaunchEmail, func() error {
+					return sendEmail(team, lastUpdate, prelaunchEmail)
+				})
+			} else if err = once(closeAction, func() error {
+				if err := closeTeam(team, lastUpdate, midnight); err != nil {
+					return err
+				}
+				emitTeamEvent(teamClosedEvent, record)
+				return nil
+			}); err == nil {
+				err = once(closedEmail, func() error {
+					return sendEmail(team, lastUpdate, closedEmail)
+				})
 			}
-			nStagnant++
 		case WARNED:
 			if prelaunch {
 				break
 			}
-			err = sendEmail(team, lastUpdate, warningEmail)
-			nWarned++
+			err = once(check.Warning.Action(), func() error {
+				if err := sendWarningEmail(team, lastUpdate, check.Warning, check.ExpiresAt); err != nil {
+					return err
+				}
+				emitTeamEvent(teamWarnedEvent, record)
+				return nil
+			})
 		case CHEAT:
-			nCheat++
-		case OK:
-			ok++
+			if len(config.Webhooks) == 0 {
+				break
+			}
+			err = once(cheatAction, func() error {
+				emitTeamEvent(teamCheatSuspectedEvent, record)
+				return nil
+			})
 		}
 		if err != nil {
-			outputErr(err, false)
-			continue
+			logError(err,
+				"step", actionStep(failedAction),
+				"action", failedAction,
+				"team_id", team.ID,
+				"project_id", team.ProjectID,
+				"status", check.Status,
+			)
+			record.Error = err.Error()
 		}
+		report.add(record)
 	}
-	output("\n")
-	stats := []struct {
-		label string
-		count int
-	}{
-		{"OK", ok},
-		{"WARNED", nWarned},
-		{"STAGNANT", nStagnant},
-		{"CHEAT", nCheat},
-	}
-	for _, stat := range stats {
-		output("%8s %4d (%.2f%%)\n", stat.label, stat.count, 100*float64(stat.count)/float64(len(teams)))
-	}
-	output("\n")
+	report.logSummary()
+	return report
 }
 
 func loadConfig(path string) error {
@@ -157,36 +337,203 @@ func loadConfig(path string) error {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return err
 	}
-	for _, ID := range config.ProjectWhitelist {
-		projectWhitelist[ID] = true
+	if config.Timezone != "" {
+		if location, err = time.LoadLocation(config.Timezone); err != nil {
+			return err
+		}
+	}
+	sum := sha256.Sum256(data)
+	configHash = hex.EncodeToString(sum[:])
+	if config.LedgerPath == "" {
+		config.LedgerPath = defaultLedgerPath
+	}
+	if config.LockPath == "" {
+		config.LockPath = defaultLockPath
+	}
+	if config.ServeAddress == "" {
+		config.ServeAddress = defaultServeAddress
+	}
+	if config.ServeRunAt == "" {
+		config.ServeRunAt = defaultServeRunAt
 	}
-	loadProjectNames(projectNamesCache)
-	output("%s GitCreeper started...\n", time.Now().Format(logTimeFormat))
+	if config.StatusLinkDays == 0 {
+		config.StatusLinkDays = defaultStatusLinkDays
+	}
+	if config.TemplatePath == "" {
+		config.TemplatePath = defaultTemplatePath
+	}
+	if config.DefaultLanguage == "" {
+		config.DefaultLanguage = defaultLanguage
+	}
+	if config.MailSpoolPath == "" {
+		config.MailSpoolPath = defaultMailSpoolPath
+	}
+	if config.WebhookMaxAttempts == 0 {
+		config.WebhookMaxAttempts = defaultWebhookAttempts
+	}
+	if config.SlackBaseURL == "" {
+		config.SlackBaseURL = defaultSlackBaseURL
+	}
+	config.SlackBaseURL = strings.TrimSuffix(config.SlackBaseURL, "/")
+	if config.MailMaxAttempts == 0 {
+		config.MailMaxAttempts = defaultMailMaxAttempts
+	}
+	initPolicies()
+	if err := validateProjectRules(); err != nil {
+		return err
+	}
+	loadProjectCache(projectNamesCache, &projectNames)
+	loadProjectCache(projectSlugsCache, &projectSlugs)
 	return nil
 }
 
-func main() {
-	if err := loadConfig("config.json"); err != nil {
-		outputErr(err, true)
-	}
-	if err := sshConnect(); err != nil {
-		outputErr(err, true)
-	}
-	defer sshConn.Close()
-	now := time.Now()
-	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).UTC()
-	expirationDate := midnight.Add(-time.Duration(config.DaysUntilStagnant) * 24 * time.Hour)
-	teams := getEligibleTeams(expirationDate)
-	processTeams(teams, midnight, expirationDate, midnight.Sub(config.StartClosingAt) < 0)
-	output("%s Creeping complete!\n", time.Now().Format(logTimeFormat))
+// Start of the current day on campus, which is the reference point for every deadline
+func getMidnight(now time.Time) time.Time {
+	now = now.In(location)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).UTC()
+}
+
+func creep() error {
+	logger.Info("GitCreeper started", "run_id", currentRunID())
+	if err := ensureSSH(); err != nil {
+		return err
+	}
+	// Without exemptions, teams that must be left alone could be closed
+	exemptions, err := getExemptions(false)
+	if err != nil {
+		return err
+	}
+	if err := resolveProjectScope(); err != nil {
+		return err
+	}
+	midnight := getMidnight(time.Now())
+	teams := getEligibleTeams(midnight)
+	report := processTeams(teams, exemptions, midnight, midnight.Sub(config.StartClosingAt) < 0)
+	// Retry mail left over from failed deliveries in this or previous runs
+	if delivered, failed, err := flushMailQueue(false); err != nil {
+		logError(err, "step", stepEmail)
+	} else if delivered+failed > 0 {
+		logger.Info("Mail queue flushed", "delivered", delivered, "failed", failed)
+	}
+	report.Undeliverable = logUndeliverable()
+	report.finish()
+	observeRun(report)
+	emitRunCompleted(report)
+	if len(config.StaffDigestAddresses) > 0 {
+		if err := sendDigest(report); err != nil {
+			logError(err, "step", stepEmail)
+		}
+	}
+	if *reportFormat != "" || *reportFile != "" {
+		if err := writeReport(report); err != nil {
+			logError(err, "step", stepReport)
+		}
+	}
+	finishRun()
+	logger.Info("Creeping complete", "run_id", currentRunID())
 	if config.SlackLogging {
-		if err := postLogs(midnight); err != nil {
-			outputErr(err, false)
+		if err := postLogs(report); err != nil {
+			logError(err, "step", stepSlack)
+		}
+	}
+	return nil
+}
+
+// Run the requested command; errors are returned to main instead of exiting so that cleanup always happens
+func run() error {
+	setRunID(time.Now().UTC().Format(runIDFormat))
+	if err := initLogger(); err != nil {
+		return err
+	}
+	if err := loadConfig("config.json"); err != nil {
+		return err
+	}
+	if err := initSentry(); err != nil {
+		return err
+	}
+	if _, err := getReportFormat(); err != nil {
+		return err
+	}
+	if err := openLedger(config.LedgerPath); err != nil {
+		return err
+	}
+	initMetrics()
+	var err error
+	command := flag.Arg(0)
+	switch command {
+	case "":
+		err = runCreep()
+	case "serve":
+		err = serveCommand(flag.Args()[1:])
+	case "reopen":
+		startRun(command)
+		err = reopenCommand(flag.Args()[1:])
+		finishRun()
+	case "mail":
+		startRun(command)
+		err = mailCommand(flag.Args()[1:])
+		finishRun()
+	case "template":
+		err = templateCommand(flag.Args()[1:])
+	case "history":
+		err = historyCommand(flag.Args()[1:])
+	case "exempt":
+		err = exemptCommand(flag.Args()[1:])
+	case "projects":
+		err = projectsCommand(flag.Args()[1:])
+	default:
+		err = fmt.Errorf("unknown command: %s", command)
+	}
+	saveProjectCaches()
+	return err
+}
+
+// Cache project names so that Intra doesn't have to be repeatedly queried for constants
+func saveProjectCaches() {
+	projectCacheMu.Lock()
+	defer projectCacheMu.Unlock()
+	if projectCacheUpdated {
+		saveProjectCache(projectNamesCache, &projectNames)
+		saveProjectCache(projectSlugsCache, &projectSlugs)
+		projectCacheUpdated = false
+	}
+}
+
+// A single run under the run lock, checked in with Sentry and exported to the metrics textfile
+func runCreep() error {
+	unlock, err := acquireRunLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	startRun("creep")
+	started := time.Now()
+	checkIn := startCheckIn()
+	if err = creep(); err != nil {
+		metricRuns.Inc("failure")
+	}
+	finishCheckIn(checkIn, started, err)
+	// Only runs are exported, so that other commands don't reset the textfile's counters
+	if config.MetricsTextfile != "" {
+		if err := writeMetricsTextfile(config.MetricsTextfile); err != nil {
+			logError(err)
 		}
 	}
-	// Cache project names so that Intra doesn't have to be repeatedly queried for constants
-	if projectNamesCacheUpdated {
-		saveProjectNames(projectNamesCache)
+	saveProjectCaches()
+	return err
+}
+
+func main() {
+	flag.Parse()
+	err := run()
+	if err != nil {
+		logError(err)
 	}
+	closeSSH()
+	closeMailer()
+	closeLedger()
 	sentry.Flush(5 * time.Second)
+	if err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+// Minimal implementation of the Prometheus text exposition format, enough for counters, gauges and histograms
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+var (
+	metricTeamsChecked = newMetricVec("gitcreeper_teams_checked_total", "Teams checked, by resulting status.",
+		"counter", "status")
+	metricClosures    = newMetricVec("gitcreeper_closures_total", "Teams closed for being stagnant.", "counter")
+	metricRuns        = newMetricVec("gitcreeper_runs_total", "Completed runs, by result.", "counter", "result")
+	metricRunDuration = newMetricVec("gitcreeper_run_duration_seconds", "Duration of the last run.", "gauge")
+	metricLastSuccess = newMetricVec("gitcreeper_last_success_timestamp_seconds",
+		"Time at which the last successful run finished.", "gauge")
+	metricIntraRequests = newMetricVec("gitcreeper_intra_requests_total",
+		"Requests to the Intra API, by method and status code (0 if no response was received).", "counter",
+		"method", "code")
+	metricEmails = newMetricVec("gitcreeper_emails_total", "Email delivery attempts, by type and result.", "counter",
+		"type", "result")
+	metricVacationErrors = newMetricVec("gitcreeper_vacation_lookup_errors_total",
+		"Failed lookups of student vacations.", "counter")
+	metricErrors      = newMetricVec("gitcreeper_errors_total", "Errors reported during runs.", "counter")
+	metricSSHDuration = &histogram{
+		name:    "gitcreeper_ssh_command_duration_seconds",
+		help:    "Latency of commands run on the repository server.",
+		buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}
+	metricVecs = []*metricVec{
+		metricTeamsChecked,
+		metricClosures,
+		metricRuns,
+		metricRunDuration,
+		metricLastSuccess,
+		metricIntraRequests,
+		metricEmails,
+		metricVacationErrors,
+		metricErrors,
+	}
+)
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (m *metricVec) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	pairs := make([]string, len(m.labels))
+	for i, label := range m.labels {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, escapeLabelValue(labelValues[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	key := m.key(labelValues)
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) Set(v float64, labelValues ...string) {
+	key := m.key(labelValues)
+	m.mu.Lock()
+	m.values[key] = v
+	m.mu.Unlock()
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatSample(name, labels string, v float64) string {
+	if labels == "" {
+		return fmt.Sprintf("%s %s\n", name, formatMetricValue(v))
+	}
+	return fmt.Sprintf("%s{%s} %s\n", name, labels, formatMetricValue(v))
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Unlabelled metrics are always exposed so that alerts don't depend on something having happened
+	if len(m.values) == 0 && len(m.labels) > 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if len(m.values) == 0 {
+		_, _ = io.WriteString(w, formatSample(m.name, "", 0))
+		return
+	}
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, _ = io.WriteString(w, formatSample(m.name, key, m.values[key]))
+	}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.buckets {
+		var count uint64
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+		_, _ = io.WriteString(w, formatSample(h.name+"_bucket", fmt.Sprintf(`le="%s"`, formatMetricValue(bound)), float64(count)))
+	}
+	_, _ = io.WriteString(w, formatSample(h.name+"_bucket", `le="+Inf"`, float64(h.count)))
+	_, _ = io.WriteString(w, formatSample(h.name+"_sum", "", h.sum))
+	_, _ = io.WriteString(w, formatSample(h.name+"_count", "", float64(h.count)))
+}
+
+func writeMetrics(w io.Writer) {
+	for _, m := range metricVecs {
+		m.write(w)
+	}
+	metricSSHDuration.write(w)
+}
+
+func initMetrics() {
+	intra.RequestHook = func(method string, statusCode int) {
+		metricIntraRequests.Inc(method, strconv.Itoa(statusCode))
+	}
+}
+
+// Fold a finished run into the metrics
+func observeRun(report *RunReport) {
+	for _, record := range report.Teams {
+		metricTeamsChecked.Inc(record.Status)
+	}
+	metricRunDuration.Set(report.FinishedAt.Sub(report.StartedAt).Seconds())
+	metricRuns.Inc("success")
+	metricLastSuccess.Set(float64(report.FinishedAt.Unix()))
+}
+
+// Carry the last success over from the previous textfile when this run failed, since each run starts from zero
+func loadLastSuccess(path string) {
+	if len(metricLastSuccess.values) > 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == metricLastSuccess.name {
+			if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				metricLastSuccess.Set(v)
+			}
+		}
+	}
+}
+
+// Written for node_exporter's textfile collector, through a temporary file so that it never scrapes a partial file
+func writeMetricsTextfile(path string) error {
+	loadLastSuccess(path)
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writeMetrics(f)
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, os.FileMode(0644)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func timeSSHCommand(start time.Time) {
+	metricSSHDuration.Observe(time.Since(start).Seconds())
+}
@@ -1,74 +1,56 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"log"
-	"net/http"
-	"net/url"
+	"log/slog"
 	"os"
 	"strings"
-	"text/tabwriter"
-	"time"
 
-	"github.com/getsentry/sentry-go"
+	"gitcreeper/intra"
 )
 
-var logBuffer strings.Builder
+var (
+	logLevel  = flag.String("log-level", "info", "minimum level of log messages: debug, info, warn or error")
+	logFormat = flag.String("log-format", "text", "format of log messages: text or json")
+	// Replaced by initLogger once the flags are parsed
+	logger = slog.Default()
+)
 
-func output(format string, args ...interface{}) {
-	out := fmt.Sprintf(format, args...)
-	if config.SlackLogging {
-		logBuffer.WriteString(out)
+func initLogger() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid log level: %s", *logLevel)
 	}
-	_, _ = os.Stdout.WriteString(strings.ReplaceAll(out, "\t", " "))
-}
-
-func outputErr(err error, fatal bool) {
-	log.Println(err)
-	sentry.CaptureException(err)
-	if fatal {
-		sentry.Flush(5 * time.Second)
-		os.Exit(1)
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format: %s", *logFormat)
 	}
+	logger = slog.New(breadcrumbHandler{Handler: handler})
+	// The intra package logs through the standard logger, which forwards to the default slog handler
+	slog.SetDefault(logger)
+	return nil
 }
 
-func getFormattedOutput() string {
-	buff := &strings.Builder{}
-	tw := tabwriter.NewWriter(buff, 0, 1, 1, ' ', 0)
-	lines := strings.Split(logBuffer.String(), "\n")
-	header := true
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "Checking") {
-			_, _ = fmt.Fprintf(tw, "%s\n", line)
-			continue
-		}
-		if header {
-			_, _ = tw.Write([]byte("TEAM ID\tPROJECT\tLOGIN\tSTATUS\tLAST COMMIT\n"))
-			_, _ = tw.Write([]byte("=======\t=======\t=====\t======\t===========\n"))
-			header = false
-			continue
-		}
-		cols := strings.Split(line, "\t")
-		cols[1] = cols[1][1 : len(cols[1])-1]
-		cols[3] = cols[3][1 : len(cols[3])-4]
-		cols[5] = cols[5][14 : len(cols[5])-1]
-		_, _ = fmt.Fprintf(tw, "%s\n", strings.Join(cols[1:], "\t"))
-	}
-	_ = tw.Flush()
-	out := buff.String()
-	return out[:len(out)-1]
+// Logger annotated with the fields identifying a team
+func teamLogger(team *intra.Team) *slog.Logger {
+	return logger.With(
+		"team_id", team.ID,
+		"project_id", team.ProjectID,
+		"logins", strings.Join(getIntraIDs(team), ","),
+	)
 }
 
-func postLogs(midnight time.Time) error {
-	params := url.Values{}
-	params.Set("token", os.Getenv("SLACK_TOKEN"))
-	params.Set("channels", config.SlackOutputChannel)
-	params.Set("content", getFormattedOutput())
-	params.Set("title", "GitCreeper Report "+midnight.Local().Format(logTimeFormat))
-	resp, err := http.PostForm("https://slack.com/api/files.upload", params)
-	if err != nil {
-		return err
-	}
-	_ = resp.Body.Close()
-	return nil
+// Log an error along with any attributes, and keep track of it in the ledger, metrics and Sentry
+func logError(err error, args ...any) {
+	logger.Error(err.Error(), args...)
+	recordError(err)
+	metricErrors.Inc()
+	captureError(err, args...)
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+// Thresholds applied to a team; fields left empty fall back to the global settings in Config
+type Policy struct {
+	Name              string
+	ProjectIDs        []int
+	ProjectSlugs      []string
+	CursusIDs         []int
+	DaysUntilStagnant int
+	DaysToCorrect     int
+	WarningSchedule   []WarningStage
+	// Branches considered when looking for the last commit; HEAD if empty
+	Branches []string
+}
+
+var (
+	defaultPolicy Policy
+	// Cursus through which each eligible team was retrieved
+	teamCursus = make(map[int]int)
+)
+
+func fillWarningSchedule(schedule []WarningStage) {
+	for i := range schedule {
+		stage := &schedule[i]
+		if stage.Template == "" {
+			stage.Template = warningEmail
+		}
+	}
+}
+
+func initPolicies() {
+	defaultPolicy = Policy{
+		Name:              "default",
+		DaysUntilStagnant: config.DaysUntilStagnant,
+		DaysToCorrect:     config.DaysToCorrect,
+		WarningSchedule:   config.WarningSchedule,
+		Branches:          config.Branches,
+	}
+	if len(defaultPolicy.WarningSchedule) == 0 {
+		defaultPolicy.WarningSchedule = []WarningStage{{HoursBefore: 24}}
+	}
+	fillWarningSchedule(defaultPolicy.WarningSchedule)
+	for i := range config.Policies {
+		policy := &config.Policies[i]
+		if policy.Name == "" {
+			policy.Name = fmt.Sprintf("policy-%d", i+1)
+		}
+		if policy.DaysUntilStagnant == 0 {
+			policy.DaysUntilStagnant = defaultPolicy.DaysUntilStagnant
+		}
+		if policy.DaysToCorrect == 0 {
+			policy.DaysToCorrect = defaultPolicy.DaysToCorrect
+		}
+		if len(policy.WarningSchedule) == 0 {
+			policy.WarningSchedule = defaultPolicy.WarningSchedule
+		}
+		if len(policy.Branches) == 0 {
+			policy.Branches = defaultPolicy.Branches
+		}
+		fillWarningSchedule(policy.WarningSchedule)
+	}
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, str string) bool {
+	for _, v := range list {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Most specific match wins: project ID, then project slug, then cursus, then the global defaults
+func getPolicy(team *intra.Team) *Policy {
+	for i := range config.Policies {
+		if containsInt(config.Policies[i].ProjectIDs, team.ProjectID) {
+			return &config.Policies[i]
+		}
+	}
+	for i := range config.Policies {
+		if len(config.Policies[i].ProjectSlugs) > 0 &&
+			containsString(config.Policies[i].ProjectSlugs, getProjectSlug(team.ProjectID)) {
+			return &config.Policies[i]
+		}
+	}
+	if cursusID, present := teamCursus[team.ID]; present {
+		for i := range config.Policies {
+			if containsInt(config.Policies[i].CursusIDs, cursusID) {
+				return &config.Policies[i]
+			}
+		}
+	}
+	return &defaultPolicy
+}
+
+func (policy *Policy) String() string {
+	return fmt.Sprintf("%s %d/%d", policy.Name, policy.DaysUntilStagnant, policy.DaysToCorrect)
+}
+
+func (policy *Policy) ExpirationDate(midnight time.Time) time.Time {
+	return midnight.Add(-time.Duration(policy.DaysUntilStagnant) * 24 * time.Hour)
+}
+
+// Return the closest warning stage that last falls within, or nil if it is outside the warning schedule
+func (policy *Policy) WarningStage(last, expirationDate time.Time) *WarningStage {
+	var stage *WarningStage
+	for i := range policy.WarningSchedule {
+		s := &policy.WarningSchedule[i]
+		if last.Add(-s.Duration()).Sub(expirationDate) <= 0 && (stage == nil || s.HoursBefore < stage.HoursBefore) {
+			stage = s
+		}
+	}
+	return stage
+}
+
+// Latest date a team may have been locked at and still need a warning under any policy
+func lockedBefore(midnight time.Time) time.Time {
+	policies := append([]Policy{defaultPolicy}, config.Policies...)
+	var latest time.Time
+	for i := range policies {
+		var lead time.Duration
+		for _, stage := range policies[i].WarningSchedule {
+			if stage.Duration() > lead {
+				lead = stage.Duration()
+			}
+		}
+		if t := policies[i].ExpirationDate(midnight).Add(lead); t.Sub(latest) > 0 {
+			latest = t
+		}
+	}
+	return latest
+}
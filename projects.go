@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+
+	"gitcreeper/intra"
+)
+
+const (
+	soloProjects  = "solo"
+	groupProjects = "group"
+)
+
+// Whether a project is in scope for runs, and which rule decided it
+type ProjectDecision struct {
+	ID      int
+	Name    string
+	Slug    string
+	InScope bool
+	Reason  string
+}
+
+// Projects whose teams are checked, resolved by resolveProjectScope; nil until then
+var projectScope map[int]bool
+
+// Explicit IDs don't need the Intra project catalog, only slug patterns and discovery do
+func needsProjectCatalog() bool {
+	return config.DiscoverProjects || len(config.ProjectSlugPatterns) > 0
+}
+
+func validateProjectRules() error {
+	switch config.ProjectTeamSize {
+	case "", soloProjects, groupProjects:
+	default:
+		return fmt.Errorf("invalid ProjectTeamSize: %s", config.ProjectTeamSize)
+	}
+	for _, pattern := range append(config.ProjectSlugPatterns, config.ProjectBlacklistSlugs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid project slug pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchesSlug(patterns []string, slug string) string {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, slug); matched {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// Sessions specific to the campus take precedence over the project's default sessions
+func isSoloProject(project *intra.Project) bool {
+	var campus, defaults int
+	var campusSolo, defaultSolo bool
+	for _, session := range project.ProjectSessions {
+		if session.CampusID != nil && *session.CampusID == config.CampusID {
+			campus++
+			campusSolo = session.Solo
+		} else if session.CampusID == nil {
+			defaults++
+			defaultSolo = session.Solo
+		}
+	}
+	if campus > 0 {
+		return campusSolo
+	}
+	return defaults > 0 && defaultSolo
+}
+
+// Fetch the projects of the cursus in scope, once each
+func getProjectCatalog() (intra.Projects, error) {
+	cursusIDs := config.ProjectCursusIDs
+	if len(cursusIDs) == 0 {
+		cursusIDs = config.CursusIDs
+	}
+	seen := make(map[int]bool)
+	var catalog intra.Projects
+	for _, cursusID := range cursusIDs {
+		params := url.Values{}
+		params.Set("page[size]", "100")
+		projects := &intra.Projects{}
+		if err := projects.GetCursusProjects(context.Background(), cursusID, params); err != nil {
+			return nil, err
+		}
+		for _, project := range *projects {
+			if !seen[project.ID] {
+				seen[project.ID] = true
+				catalog = append(catalog, project)
+			}
+		}
+	}
+	return catalog, nil
+}
+
+// Blacklists win over everything, explicit IDs over attribute filters, and attribute filters over slug patterns
+// and discovery; every project in the catalog is only a candidate if DiscoverProjects is set
+func decideProject(project *intra.Project) ProjectDecision {
+	decision := ProjectDecision{ID: project.ID, Name: project.Name, Slug: project.Slug}
+	switch pattern := matchesSlug(config.ProjectBlacklistSlugs, project.Slug); {
+	case containsInt(config.ProjectBlacklist, project.ID):
+		decision.Reason = "blacklisted"
+	case pattern != "":
+		decision.Reason = "blacklisted by " + pattern
+	case containsInt(config.ProjectWhitelist, project.ID):
+		decision.InScope, decision.Reason = true, "whitelisted"
+	case config.ExcludeExamProjects && project.Exam:
+		decision.Reason = "exam"
+	case config.ProjectTeamSize == groupProjects && isSoloProject(project):
+		decision.Reason = "solo"
+	case config.ProjectTeamSize == soloProjects && !isSoloProject(project):
+		decision.Reason = "group"
+	default:
+		if pattern := matchesSlug(config.ProjectSlugPatterns, project.Slug); pattern != "" {
+			decision.InScope, decision.Reason = true, "matches "+pattern
+		} else if config.DiscoverProjects {
+			decision.InScope, decision.Reason = true, "discovered"
+		} else {
+			decision.Reason = "not selected"
+		}
+	}
+	return decision
+}
+
+// Apply the project rules to the Intra project catalog, along with whitelisted IDs missing from it
+func getProjectDecisions() ([]ProjectDecision, error) {
+	var catalog intra.Projects
+	if needsProjectCatalog() {
+		var err error
+		if catalog, err = getProjectCatalog(); err != nil {
+			return nil, err
+		}
+	}
+	decisions := make([]ProjectDecision, 0, len(catalog))
+	seen := make(map[int]bool)
+	projectCacheMu.Lock()
+	for i := range catalog {
+		project := &catalog[i]
+		seen[project.ID] = true
+		decisions = append(decisions, decideProject(project))
+		if projectNames[project.ID] != project.Name || projectSlugs[project.ID] != project.Slug {
+			projectNames[project.ID] = project.Name
+			projectSlugs[project.ID] = project.Slug
+			projectCacheUpdated = true
+		}
+	}
+	projectCacheMu.Unlock()
+	for _, ID := range config.ProjectWhitelist {
+		if seen[ID] {
+			continue
+		}
+		project := &intra.Project{ID: ID, Name: getProjectName(ID), Slug: getProjectSlug(ID)}
+		decisions = append(decisions, decideProject(project))
+	}
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].Slug < decisions[j].Slug })
+	return decisions, nil
+}
+
+func resolveProjectScope() error {
+	decisions, err := getProjectDecisions()
+	if err != nil {
+		return err
+	}
+	scope := make(map[int]bool)
+	for _, decision := range decisions {
+		if decision.InScope {
+			scope[decision.ID] = true
+		}
+	}
+	projectScope = scope
+	if len(scope) == 0 {
+		logger.Warn("No projects in scope, no teams will be checked")
+	}
+	logger.Info("Projects in scope resolved", "projects", len(scope))
+	return nil
+}
+
+// List the projects in scope, resolved against the Intra project catalog
+func projectsCommand(args []string) error {
+	usage := errors.New("usage: gitcreeper projects list [--all]")
+	if len(args) == 0 || args[0] != "list" {
+		return usage
+	}
+	fs := flag.NewFlagSet("projects list", flag.ExitOnError)
+	all := fs.Bool("all", false, "also list excluded projects and why")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usage
+	}
+	decisions, err := getProjectDecisions()
+	if err != nil {
+		return err
+	}
+	nInScope := 0
+	for _, decision := range decisions {
+		if decision.InScope {
+			nInScope++
+		} else if !*all {
+			continue
+		}
+		state := "IN"
+		if !decision.InScope {
+			state = "OUT"
+		}
+		fmt.Printf("%-3s %6s %-32s %s (%s)\n", state, strconv.Itoa(decision.ID), decision.Slug, decision.Name,
+			decision.Reason)
+	}
+	fmt.Printf("%d projects in scope.\n", nInScope)
+	return nil
+}
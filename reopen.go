@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+// Values a team had before GitCreeper closed it, so the closure can be reverted
+type Closure struct {
+	ID                int64
+	TeamID            int
+	RunID             string
+	ClosedAt          time.Time
+	TerminatingAt     time.Time
+	PrevClosedAt      time.Time
+	PrevTerminatingAt time.Time
+	LastUpdate        *time.Time
+	ReopenedAt        *time.Time
+}
+
+// Intra expects an empty value to clear a date field
+func formatIntraTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(intraTimeFormat)
+}
+
+func reopenTeam(closure *Closure) error {
+	team := &intra.Team{}
+	if err := team.GetTeam(context.Background(), true, closure.TeamID); err != nil {
+		return err
+	}
+	if team.ID == 0 {
+		return fmt.Errorf("team %d not found", closure.TeamID)
+	}
+	patched := *team
+	patched.ClosedAt = closure.PrevClosedAt
+	patched.TerminatingAt = closure.PrevTerminatingAt
+	params := url.Values{}
+	params.Set("team[closed_at]", formatIntraTime(patched.ClosedAt))
+	params.Set("team[terminating_at]", formatIntraTime(patched.TerminatingAt))
+	_, resp, err := patched.PatchTeam(context.Background(), true, params)
+	recordAction("reopened", closure.TeamID, "closure from run "+closure.RunID+" reverted", params, resp, err)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	closure.ReopenedAt = &now
+	if err := markReopened(closure); err != nil {
+		return err
+	}
+	return sendEmail(&patched, closure.LastUpdate, reopenedEmail)
+}
+
+// Revert closures made by GitCreeper, either for a single team or for an entire run
+func reopenCommand(args []string) error {
+	fs := flag.NewFlagSet("reopen", flag.ExitOnError)
+	run := fs.String("run", "", "reopen every team closed during the given run ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	teamID := 0
+	if *run == "" {
+		if fs.NArg() != 1 {
+			return errors.New("usage: gitcreeper reopen <team-id> | --run <run-id>")
+		}
+		ID, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		teamID = ID
+	}
+	closures, err := getOpenClosures(teamID, *run)
+	if err != nil {
+		return err
+	}
+	// A single team only reopens its most recent closure
+	if teamID != 0 && len(closures) > 1 {
+		closures = closures[:1]
+	}
+	nReopened := 0
+	for i := range closures {
+		closure := &closures[i]
+		if err := reopenTeam(closure); err != nil {
+			logError(err, "step", stepIntra, "team_id", closure.TeamID, "closed_in_run", closure.RunID)
+		} else {
+			logger.Info("Team reopened", "team_id", closure.TeamID, "closed_in_run", closure.RunID)
+		}
+		if closure.ReopenedAt != nil {
+			nReopened++
+		}
+	}
+	if nReopened == 0 {
+		return errors.New("no matching closures to reopen")
+	}
+	fmt.Printf("%d teams reopened.\n", nReopened)
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+var (
+	reportFormat = flag.String("report-format", "", "write the run report as json, csv or text")
+	reportFile   = flag.String("report-file", "", "file to write the run report to (default stdout)")
+)
+
+// Order in which statuses are totalled
+var reportStatuses = []string{OK, WARNED, STAGNANT, CHEAT, EXEMPT, ERROR}
+
+// Outcome of checking a single team
+type TeamRecord struct {
+	TeamID       int        `json:"team_id"`
+	URL          string     `json:"url"`
+	ProjectID    int        `json:"project_id"`
+	Project      string     `json:"project"`
+	Logins       []string   `json:"logins"`
+	Status       string     `json:"status"`
+	LastCommit   *time.Time `json:"last_commit"`
+	VacationDays float64    `json:"vacation_days"`
+	Policy       string     `json:"policy"`
+	// Actions applied during this run, e.g. close or warning:24h
+	Actions []string `json:"actions"`
+	// Actions skipped because they were already applied
+	Skipped []string `json:"skipped"`
+	// Reason the team is exempt, if EXEMPT
+	Exemption string `json:"exemption,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Spooled email that exhausted its retries, in this or a previous run
+type UndeliverableMail struct {
+	ID        string   `json:"id"`
+	TeamID    int      `json:"team_id"`
+	Type      string   `json:"type"`
+	To        []string `json:"to"`
+	Attempts  int      `json:"attempts"`
+	LastError string   `json:"last_error"`
+}
+
+type RunReport struct {
+	RunID         string              `json:"run_id"`
+	Day           string              `json:"day"`
+	Prelaunch     bool                `json:"prelaunch"`
+	StartedAt     time.Time           `json:"started_at"`
+	FinishedAt    time.Time           `json:"finished_at"`
+	Teams         []TeamRecord        `json:"teams"`
+	Totals        map[string]int      `json:"totals"`
+	Skipped       int                 `json:"skipped"`
+	Errors        []string            `json:"errors"`
+	Undeliverable []UndeliverableMail `json:"undeliverable"`
+}
+
+func newRunReport(midnight time.Time, prelaunch bool) *RunReport {
+	return &RunReport{
+		RunID:         currentRunID(),
+		Day:           midnight.In(location).Format(dayFormat),
+		Prelaunch:     prelaunch,
+		StartedAt:     time.Now().UTC(),
+		Teams:         []TeamRecord{},
+		Totals:        make(map[string]int),
+		Undeliverable: []UndeliverableMail{},
+	}
+}
+
+func newTeamRecord(team *intra.Team) TeamRecord {
+	return TeamRecord{
+		TeamID:    team.ID,
+		URL:       team.URL,
+		ProjectID: team.ProjectID,
+		Project:   getProjectName(team.ProjectID),
+		Logins:    getIntraIDs(team),
+		Policy:    getPolicy(team).String(),
+		Actions:   []string{},
+		Skipped:   []string{},
+	}
+}
+
+func (report *RunReport) add(record TeamRecord) {
+	report.Teams = append(report.Teams, record)
+	report.Totals[record.Status]++
+	report.Skipped += len(record.Skipped)
+}
+
+// Record errors and the end time once everything that may fail has run
+func (report *RunReport) finish() {
+	report.FinishedAt = time.Now().UTC()
+	errs, err := getRunErrors(currentRunID())
+	if err != nil {
+		logError(err, "step", stepLedger)
+	}
+	report.Errors = errs
+}
+
+func (report *RunReport) percent(status string) float64 {
+	if len(report.Teams) == 0 {
+		return 0
+	}
+	return 100 * float64(report.Totals[status]) / float64(len(report.Teams))
+}
+
+func (report *RunReport) WriteSummary(w io.Writer) {
+	for _, status := range reportStatuses {
+		_, _ = fmt.Fprintf(w, "%8s %4d (%.2f%%)\n", status, report.Totals[status], report.percent(status))
+	}
+	if report.Skipped > 0 {
+		_, _ = fmt.Fprintf(w, "\n%d actions skipped because they were already applied (use --force to repeat them).\n", report.Skipped)
+	}
+}
+
+func (report *RunReport) logSummary() {
+	args := []any{"teams", len(report.Teams)}
+	for _, status := range reportStatuses {
+		args = append(args, strings.ToLower(status), report.Totals[status])
+	}
+	logger.Info("Teams processed", append(args, "skipped", report.Skipped)...)
+	if report.Skipped > 0 {
+		logger.Info("Actions already applied today were skipped; use --force to repeat them", "skipped", report.Skipped)
+	}
+}
+
+func (report *RunReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func (report *RunReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{
+		"run_id", "team_id", "url", "project_id", "project", "logins", "status", "last_commit",
+		"vacation_days", "policy", "actions", "skipped", "error",
+	})
+	for _, record := range report.Teams {
+		lastCommit := ""
+		if record.LastCommit != nil {
+			lastCommit = record.LastCommit.UTC().Format(time.RFC3339)
+		}
+		_ = cw.Write([]string{
+			report.RunID,
+			strconv.Itoa(record.TeamID),
+			record.URL,
+			strconv.Itoa(record.ProjectID),
+			record.Project,
+			strings.Join(record.Logins, " "),
+			record.Status,
+			lastCommit,
+			strconv.FormatFloat(record.VacationDays, 'f', 1, 64),
+			record.Policy,
+			strings.Join(record.Actions, " "),
+			strings.Join(record.Skipped, " "),
+			record.Error,
+		})
+	}
+	// Undeliverable email gets a row of its own so that staff can follow up on it from the same file
+	for _, m := range report.Undeliverable {
+		_ = cw.Write([]string{
+			report.RunID,
+			strconv.Itoa(m.TeamID),
+			"", "", "", "",
+			"UNDELIVERABLE",
+			"", "", "",
+			m.Type,
+			"",
+			fmt.Sprintf("to %s after %d attempts: %s", strings.Join(m.To, " "), m.Attempts, m.LastError),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (report *RunReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 1, 1, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "GitCreeper Report %s [Run ID: %s]\n\n", report.Day, report.RunID)
+	_, _ = fmt.Fprint(tw, "TEAM ID\tPROJECT\tLOGIN\tSTATUS\tLAST COMMIT\tVACATION\tPOLICY\tACTIONS\n")
+	_, _ = fmt.Fprint(tw, "=======\t=======\t=====\t======\t===========\t========\t======\t=======\n")
+	for _, record := range report.Teams {
+		lastCommit := "Never"
+		if record.LastCommit != nil {
+			lastCommit = record.LastCommit.In(location).Format(time.RFC1123)
+		}
+		actions := strings.Join(record.Actions, ", ")
+		if record.Exemption != "" {
+			actions = "exempt: " + record.Exemption
+		}
+		if record.Error != "" {
+			actions = "error: " + record.Error
+		}
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%.1f\t%s\t%s\n",
+			record.TeamID,
+			record.Project,
+			strings.Join(record.Logins, ", "),
+			record.Status,
+			lastCommit,
+			record.VacationDays,
+			record.Policy,
+			actions,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprint(w, "\n")
+	report.WriteSummary(w)
+	if len(report.Errors) > 0 {
+		_, _ = fmt.Fprintf(w, "\nErrors:\n")
+		for _, msg := range report.Errors {
+			_, _ = fmt.Fprintf(w, "  %s\n", msg)
+		}
+	}
+	if len(report.Undeliverable) > 0 {
+		_, _ = fmt.Fprintf(w, "\nUndeliverable email:\n")
+		for _, m := range report.Undeliverable {
+			_, _ = fmt.Fprintf(w, "  %s <%d> %s %s %d attempts: %s\n",
+				m.ID, m.TeamID, m.Type, strings.Join(m.To, ","), m.Attempts, m.LastError)
+		}
+	}
+	return nil
+}
+
+func (report *RunReport) Text() string {
+	buff := &strings.Builder{}
+	_ = report.WriteText(buff)
+	return buff.String()
+}
+
+// Use the report file's extension when no format is given, falling back to text
+func getReportFormat() (string, error) {
+	switch *reportFormat {
+	case "json", "csv", "text":
+		return *reportFormat, nil
+	case "":
+		if ext := strings.ToLower(filepath.Ext(*reportFile)); ext == ".json" || ext == ".csv" {
+			return ext[1:], nil
+		}
+		return "text", nil
+	default:
+		return "", fmt.Errorf("unknown report format: %s", *reportFormat)
+	}
+}
+
+func writeReport(report *RunReport) error {
+	format, err := getReportFormat()
+	if err != nil {
+		return err
+	}
+	w := io.Writer(os.Stdout)
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch format {
+	case "json":
+		return report.WriteJSON(w)
+	case "csv":
+		return report.WriteCSV(w)
+	default:
+		return report.WriteText(w)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Steps of a run, used to tag errors with where they happened
+const (
+	stepIntra    = "intra"
+	stepSSH      = "ssh"
+	stepVacation = "vacation"
+	stepEmail    = "email"
+	stepLedger   = "ledger"
+	stepWebhook  = "webhook"
+	stepSlack    = "slack"
+	stepReport   = "report"
+	stepServe    = "serve"
+)
+
+const sentryMaxBreadcrumbs = 100
+
+func initSentry() error {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return nil
+	}
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:              dsn,
+		Release:          config.SentryRelease,
+		Environment:      config.SentryEnvironment,
+		AttachStacktrace: true,
+		MaxBreadcrumbs:   sentryMaxBreadcrumbs,
+	})
+}
+
+// Capture an error with every logged attribute as a tag, e.g. team_id, project_id and step
+func captureError(err error, args ...any) {
+	record := slog.NewRecord(time.Time{}, slog.LevelError, "", 0)
+	record.Add(args...)
+	sentry.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("run_id", currentRunID())
+		record.Attrs(func(attr slog.Attr) bool {
+			scope.SetTag(attr.Key, attr.Value.String())
+			return true
+		})
+		sentry.CaptureException(err)
+	})
+}
+
+func sentryLevel(level slog.Level) sentry.Level {
+	switch {
+	case level >= slog.LevelError:
+		return sentry.LevelError
+	case level >= slog.LevelWarn:
+		return sentry.LevelWarning
+	case level >= slog.LevelInfo:
+		return sentry.LevelInfo
+	default:
+		return sentry.LevelDebug
+	}
+}
+
+// Leaves a breadcrumb for every informational message, so captured errors show how the run got there
+type breadcrumbHandler struct {
+	slog.Handler
+	attrs []slog.Attr
+}
+
+// Breadcrumbs are kept even when the message is below the configured log level
+func (h breadcrumbHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || h.Handler.Enabled(ctx, level)
+}
+
+func (h breadcrumbHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelInfo {
+		data := make(map[string]interface{}, len(h.attrs)+record.NumAttrs())
+		for _, attr := range h.attrs {
+			data[attr.Key] = attr.Value.Any()
+		}
+		record.Attrs(func(attr slog.Attr) bool {
+			data[attr.Key] = attr.Value.Any()
+			return true
+		})
+		sentry.AddBreadcrumb(&sentry.Breadcrumb{
+			Category:  "log",
+			Message:   record.Message,
+			Level:     sentryLevel(record.Level),
+			Data:      data,
+			Timestamp: record.Time,
+		})
+	}
+	if !h.Handler.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h breadcrumbHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return breadcrumbHandler{
+		Handler: h.Handler.WithAttrs(attrs),
+		attrs:   append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...),
+	}
+}
+
+func (h breadcrumbHandler) WithGroup(name string) slog.Handler {
+	return breadcrumbHandler{Handler: h.Handler.WithGroup(name), attrs: h.attrs}
+}
+
+// Report the start of a nightly run to Sentry Crons, which alerts when a run is missed or doesn't finish
+func startCheckIn() *sentry.EventID {
+	if config.SentryMonitorSlug == "" || sentry.CurrentHub().Client() == nil {
+		return nil
+	}
+	var monitor *sentry.MonitorConfig
+	if config.SentryMonitorSchedule != "" {
+		monitor = &sentry.MonitorConfig{
+			Schedule:      sentry.CrontabSchedule(config.SentryMonitorSchedule),
+			CheckInMargin: 30,
+			MaxRuntime:    120,
+			Timezone:      config.Timezone,
+		}
+	}
+	return sentry.CaptureCheckIn(&sentry.CheckIn{
+		MonitorSlug: config.SentryMonitorSlug,
+		Status:      sentry.CheckInStatusInProgress,
+	}, monitor)
+}
+
+func finishCheckIn(id *sentry.EventID, started time.Time, runErr error) {
+	if id == nil {
+		return
+	}
+	status := sentry.CheckInStatusOK
+	if runErr != nil {
+		status = sentry.CheckInStatusError
+	}
+	sentry.CaptureCheckIn(&sentry.CheckIn{
+		ID:          *id,
+		MonitorSlug: config.SentryMonitorSlug,
+		Status:      status,
+		Duration:    time.Since(started),
+	}, nil)
+}
+
+// Step in which an action applied to a team may fail
+func actionStep(action string) string {
+	switch action {
+	case closeAction:
+		return stepIntra
+	case cheatAction:
+		return stepWebhook
+	default:
+		return stepEmail
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+const (
+	defaultServeAddress = "127.0.0.1:8080"
+	defaultServeRunAt   = "03:00"
+	defaultLockPath     = ".gitcreeper.lock"
+	runAtFormat         = "15:04"
+	keepaliveInterval   = time.Minute
+)
+
+var (
+	// Held for the duration of a run, so that the scheduler, keepalives and readiness checks don't interfere
+	runMu sync.Mutex
+	// State of the scheduler, reported by the readiness endpoint
+	daemonMu   sync.Mutex
+	lastRunAt  time.Time
+	lastRunErr error
+	nextRunAt  time.Time
+)
+
+// Take an exclusive lock on the lock file so that cron and the daemon never run at the same time
+func acquireRunLock() (func(), error) {
+	f, err := os.OpenFile(config.LockPath, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("another run holds %s", config.LockPath)
+		}
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
+
+// Next time of day at which a run is due, in the campus timezone
+func nextRun(now time.Time, runAt time.Time) time.Time {
+	now = now.In(location)
+	next := time.Date(now.Year(), now.Month(), now.Day(), runAt.Hour(), runAt.Minute(), 0, 0, location)
+	if !next.After(now) {
+		next = time.Date(now.Year(), now.Month(), now.Day()+1, runAt.Hour(), runAt.Minute(), 0, 0, location)
+	}
+	return next
+}
+
+// Reset the state that belongs to a single run
+func beginScheduledRun() {
+	setRunID(time.Now().UTC().Format(runIDFormat))
+	teamCursus = make(map[int]int)
+	intra.ClearCache()
+}
+
+func scheduledRun() {
+	runMu.Lock()
+	defer runMu.Unlock()
+	beginScheduledRun()
+	err := runCreep()
+	if err != nil {
+		logError(err)
+	}
+	daemonMu.Lock()
+	lastRunAt, lastRunErr = time.Now(), err
+	daemonMu.Unlock()
+}
+
+// Keep the SSH connection and Intra tokens ready between runs
+func keepWarm() {
+	if !runMu.TryLock() {
+		return
+	}
+	defer runMu.Unlock()
+	if err := ensureSSH(); err != nil {
+		logger.Warn("Could not keep the SSH connection alive", "error", err)
+	}
+	if err := intra.WarmUp(); err != nil {
+		logger.Warn("Could not refresh the Intra token", "error", err)
+	}
+}
+
+func schedule(ctx context.Context, runAt time.Time) {
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		next := nextRun(time.Now(), runAt)
+		daemonMu.Lock()
+		nextRunAt = next
+		daemonMu.Unlock()
+		logger.Info("Next run scheduled", "at", next)
+		timer := time.NewTimer(time.Until(next))
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-keepalive.C:
+				keepWarm()
+			case <-timer.C:
+				scheduledRun()
+				break wait
+			}
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Ready once the ledger and repository server are reachable; checks are skipped while a run is using them
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	ready := true
+	fail := func(name string, err error) {
+		checks[name] = err.Error()
+		ready = false
+	}
+	if err := ledger.PingContext(r.Context()); err != nil {
+		fail("ledger", err)
+	} else {
+		checks["ledger"] = "ok"
+	}
+	if runMu.TryLock() {
+		if err := ensureSSH(); err != nil {
+			fail("ssh", err)
+		} else {
+			checks["ssh"] = "ok"
+		}
+		runMu.Unlock()
+	} else {
+		checks["ssh"] = "in use"
+	}
+	daemonMu.Lock()
+	state := map[string]interface{}{
+		"checks":   checks,
+		"next_run": nextRunAt,
+	}
+	if !lastRunAt.IsZero() {
+		state["last_run"] = lastRunAt
+		state["last_run_error"] = nil
+		if lastRunErr != nil {
+			state["last_run_error"] = lastRunErr.Error()
+		}
+	}
+	daemonMu.Unlock()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	state["ready"] = ready
+	writeJSON(w, status, state)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+// Stay resident, running daily at ServeRunAt and serving health, readiness and metrics endpoints
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", config.ServeAddress, "address to serve health, readiness and metrics endpoints on")
+	runNow := flags.Bool("run-now", false, "start a run immediately instead of waiting for the scheduled time")
+	openDashboard := flags.Bool("open-dashboard", false, "serve the dashboard without signing in when DASHBOARD_PASSWORD is not set")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: gitcreeper serve [--addr <address>] [--run-now] [--open-dashboard]")
+	}
+	runAt, err := time.Parse(runAtFormat, config.ServeRunAt)
+	if err != nil {
+		return fmt.Errorf("invalid ServeRunAt: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mountDashboard(mux, *openDashboard)
+	mountStatus(mux)
+	server := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	logger.Info("Serving", "addr", *addr, "run_at", config.ServeRunAt, "timezone", location.String())
+	keepWarm()
+	if *runNow {
+		scheduledRun()
+	}
+	done := make(chan struct{})
+	go func() {
+		schedule(ctx, runAt)
+		close(done)
+	}()
+	select {
+	case err = <-serverErr:
+		stop()
+	case <-ctx.Done():
+	}
+	<-done
+	logger.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_ = server.Shutdown(shutdownCtx)
+	// Wait for a run in progress to finish
+	runMu.Lock()
+	defer runMu.Unlock()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
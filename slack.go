@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSlackBaseURL = "https://slack.com/api"
+	slackTimeout        = 30 * time.Second
+	// Slack rejects section blocks with more text than this
+	slackSectionLimit = 3000
+)
+
+// Every Slack Web API response carries ok, and failures are reported with HTTP 200
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+func (resp *slackResponse) err(method string) error {
+	if resp.OK {
+		return nil
+	}
+	return fmt.Errorf("slack %s: %s", method, resp.Error)
+}
+
+type (
+	slackText struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	slackBlock struct {
+		Type     string      `json:"type"`
+		Text     *slackText  `json:"text,omitempty"`
+		Fields   []slackText `json:"fields,omitempty"`
+		Elements []slackText `json:"elements,omitempty"`
+	}
+)
+
+var slackClient = &http.Client{Timeout: slackTimeout}
+
+func slackCall(method string, req *http.Request, res interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("SLACK_TOKEN"))
+	resp, err := slackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack %s: %s", method, resp.Status)
+	}
+	return json.Unmarshal(body, res)
+}
+
+func slackPostJSON(method string, payload interface{}, res interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, config.SlackBaseURL+"/"+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return slackCall(method, req, res)
+}
+
+func slackPostForm(method string, params url.Values, res interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, config.SlackBaseURL+"/"+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return slackCall(method, req, res)
+}
+
+func truncateSlackText(text string) string {
+	if len(text) <= slackSectionLimit {
+		return text
+	}
+	cut := strings.LastIndex(text[:slackSectionLimit-2], "\n")
+	if cut < 0 {
+		cut = slackSectionLimit - 2
+	}
+	return text[:cut] + "\n…"
+}
+
+// Status counts, then each project's teams by status
+func getSlackBlocks(report *RunReport) []slackBlock {
+	title := fmt.Sprintf("GitCreeper Report %s", report.Day)
+	if report.Prelaunch {
+		title += " (prelaunch)"
+	}
+	blocks := []slackBlock{{
+		Type: "header",
+		Text: &slackText{Type: "plain_text", Text: title},
+	}}
+	counts := slackBlock{Type: "section"}
+	for _, status := range reportStatuses {
+		counts.Fields = append(counts.Fields, slackText{
+			Type: "mrkdwn",
+			Text: fmt.Sprintf("*%s*\n%d (%.2f%%)", status, report.Totals[status], report.percent(status)),
+		})
+	}
+	blocks = append(blocks, counts)
+	projects := make(map[string]map[string]int)
+	for _, record := range report.Teams {
+		if projects[record.Project] == nil {
+			projects[record.Project] = make(map[string]int)
+		}
+		projects[record.Project][record.Status]++
+	}
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	breakdown := &strings.Builder{}
+	for _, name := range names {
+		var counts []string
+		for _, status := range reportStatuses {
+			if n := projects[name][status]; n > 0 {
+				counts = append(counts, strconv.Itoa(n)+" "+status)
+			}
+		}
+		_, _ = fmt.Fprintf(breakdown, "*%s*: %s\n", name, strings.Join(counts, ", "))
+	}
+	if breakdown.Len() > 0 {
+		blocks = append(blocks, slackBlock{Type: "divider"}, slackBlock{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: truncateSlackText(breakdown.String())},
+		})
+	}
+	if len(report.Undeliverable) > 0 {
+		undeliverable := &strings.Builder{}
+		_, _ = fmt.Fprintf(undeliverable, "*Undeliverable email (%d)*\n", len(report.Undeliverable))
+		for _, m := range report.Undeliverable {
+			_, _ = fmt.Fprintf(undeliverable, "`%s` %s to %s (team %d): %s\n",
+				m.ID, m.Type, strings.Join(m.To, ", "), m.TeamID, m.LastError)
+		}
+		blocks = append(blocks, slackBlock{Type: "divider"}, slackBlock{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: truncateSlackText(undeliverable.String())},
+		})
+	}
+	footer := fmt.Sprintf("Run ID: %s", report.RunID)
+	if report.Skipped > 0 {
+		footer += fmt.Sprintf(" | %d actions skipped", report.Skipped)
+	}
+	if len(report.Errors) > 0 {
+		footer += fmt.Sprintf(" | %d errors", len(report.Errors))
+	}
+	if len(report.Undeliverable) > 0 {
+		footer += fmt.Sprintf(" | %d undeliverable emails", len(report.Undeliverable))
+	}
+	blocks = append(blocks, slackBlock{
+		Type:     "context",
+		Elements: []slackText{{Type: "mrkdwn", Text: footer}},
+	})
+	return blocks
+}
+
+// Upload through files.getUploadURLExternal and files.completeUploadExternal, sharing the file in a thread
+func slackUpload(filename, title, content, threadTS string) error {
+	var upload struct {
+		slackResponse
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	params := url.Values{}
+	params.Set("filename", filename)
+	params.Set("length", strconv.Itoa(len(content)))
+	if err := slackPostForm("files.getUploadURLExternal", params, &upload); err != nil {
+		return err
+	}
+	if err := upload.err("files.getUploadURLExternal"); err != nil {
+		return err
+	}
+	resp, err := slackClient.Post(upload.UploadURL, "text/plain; charset=utf-8", strings.NewReader(content))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack file upload: %s", resp.Status)
+	}
+	type slackFile struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	}
+	complete := struct {
+		Files     []slackFile `json:"files"`
+		ChannelID string      `json:"channel_id"`
+		ThreadTS  string      `json:"thread_ts,omitempty"`
+	}{
+		Files:     []slackFile{{ID: upload.FileID, Title: title}},
+		ChannelID: config.SlackOutputChannel,
+		ThreadTS:  threadTS,
+	}
+	var res slackResponse
+	if err := slackPostJSON("files.completeUploadExternal", complete, &res); err != nil {
+		return err
+	}
+	return res.err("files.completeUploadExternal")
+}
+
+// Post a summary to the channel, with the full report attached in its thread
+func postLogs(report *RunReport) error {
+	if os.Getenv("SLACK_TOKEN") == "" {
+		return errors.New("SLACK_TOKEN is not set")
+	}
+	blocks := getSlackBlocks(report)
+	message := struct {
+		Channel string       `json:"channel"`
+		Text    string       `json:"text"`
+		Blocks  []slackBlock `json:"blocks"`
+	}{
+		Channel: config.SlackOutputChannel,
+		Text:    blocks[0].Text.Text,
+		Blocks:  blocks,
+	}
+	var posted struct {
+		slackResponse
+		TS string `json:"ts"`
+	}
+	if err := slackPostJSON("chat.postMessage", message, &posted); err != nil {
+		return err
+	}
+	if err := posted.err("chat.postMessage"); err != nil {
+		return err
+	}
+	title := fmt.Sprintf("GitCreeper Report %s [Run ID: %s]", report.Day, report.RunID)
+	return slackUpload("gitcreeper-"+report.RunID+".txt", title, report.Text(), posted.TS)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testRunReport() *RunReport {
+	report := &RunReport{
+		RunID:         "20240301T030000Z",
+		Day:           "2024-03-01",
+		Totals:        make(map[string]int),
+		Undeliverable: []UndeliverableMail{},
+	}
+	report.add(TeamRecord{TeamID: 1, Project: "libft", Logins: []string{"alogin"}, Status: OK})
+	report.add(TeamRecord{TeamID: 2, Project: "libft", Logins: []string{"blogin"}, Status: STAGNANT, Actions: []string{"close"}})
+	return report
+}
+
+// Fake Slack Web API, recording the calls postLogs makes
+func newFakeSlack(t *testing.T) (*httptest.Server, map[string]string) {
+	calls := make(map[string]string)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		calls[r.URL.Path] = string(body)
+		if r.URL.Path != "/upload" && r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			t.Errorf("%s: Authorization is %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		switch r.URL.Path {
+		case "/chat.postMessage":
+			_, _ = io.WriteString(w, `{"ok": true, "ts": "1709262000.000100"}`)
+		case "/files.getUploadURLExternal":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"ok":         true,
+				"upload_url": server.URL + "/upload",
+				"file_id":    "F123",
+			})
+		case "/upload":
+			_, _ = io.WriteString(w, "OK")
+		case "/files.completeUploadExternal":
+			_, _ = io.WriteString(w, `{"ok": true}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return server, calls
+}
+
+func TestPostLogs(t *testing.T) {
+	server, calls := newFakeSlack(t)
+	defer server.Close()
+	saved := config
+	defer func() { config = saved }()
+	config.SlackBaseURL = server.URL
+	config.SlackOutputChannel = "C123"
+	t.Setenv("SLACK_TOKEN", "xoxb-test")
+
+	report := testRunReport()
+	if err := postLogs(report); err != nil {
+		t.Fatal(err)
+	}
+	var message struct {
+		Channel string       `json:"channel"`
+		Text    string       `json:"text"`
+		Blocks  []slackBlock `json:"blocks"`
+	}
+	if err := json.Unmarshal([]byte(calls["/chat.postMessage"]), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Channel != "C123" || message.Text != "GitCreeper Report 2024-03-01" {
+		t.Errorf("posted %q to %q", message.Text, message.Channel)
+	}
+	if len(message.Blocks) == 0 || message.Blocks[0].Type != "header" {
+		t.Errorf("message doesn't start with a header: %+v", message.Blocks)
+	}
+	if !strings.Contains(calls["/files.getUploadURLExternal"], "filename=gitcreeper-20240301T030000Z.txt") {
+		t.Errorf("upload requested with %q", calls["/files.getUploadURLExternal"])
+	}
+	if calls["/upload"] != report.Text() {
+		t.Errorf("uploaded %q, want the text report", calls["/upload"])
+	}
+	var complete struct {
+		Files     []struct{ ID string } `json:"files"`
+		ChannelID string                `json:"channel_id"`
+		ThreadTS  string                `json:"thread_ts"`
+	}
+	if err := json.Unmarshal([]byte(calls["/files.completeUploadExternal"]), &complete); err != nil {
+		t.Fatal(err)
+	}
+	if len(complete.Files) != 1 || complete.Files[0].ID != "F123" ||
+		complete.ChannelID != "C123" || complete.ThreadTS != "1709262000.000100" {
+		t.Errorf("upload completed with %+v", complete)
+	}
+}
+
+func TestPostLogsSlackError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"ok": false, "error": "channel_not_found"}`)
+	}))
+	defer server.Close()
+	saved := config
+	defer func() { config = saved }()
+	config.SlackBaseURL = server.URL
+	t.Setenv("SLACK_TOKEN", "xoxb-test")
+
+	err := postLogs(testRunReport())
+	if err == nil || !strings.Contains(err.Error(), "channel_not_found") {
+		t.Errorf("expected channel_not_found, got %v", err)
+	}
+	t.Setenv("SLACK_TOKEN", "")
+	if err := postLogs(testRunReport()); err == nil {
+		t.Error("expected an error without SLACK_TOKEN")
+	}
+}
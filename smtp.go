@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	smtpAuthPlain   = "plain"
+	smtpAuthLogin   = "login"
+	smtpAuthCRAMMD5 = "cram-md5"
+
+	smtpSecurityStartTLS = "starttls"
+	smtpSecurityTLS      = "tls"
+	smtpSecurityNone     = "none"
+
+	// Bounds connecting and each message, so that an unresponsive relay can't hold the run lock forever
+	smtpTimeout = time.Minute
+)
+
+// Delivers over a single SMTP session shared by every message of a run
+type SMTPMailer struct {
+	client *smtp.Client
+	conn   net.Conn
+}
+
+// net/smtp only implements PLAIN and CRAM-MD5; Office 365 relays commonly require LOGIN
+type loginAuth struct {
+	username, password string
+}
+
+func (auth *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (auth *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(auth.username), nil
+	case "password:":
+		return []byte(auth.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %s", fromServer)
+}
+
+func getSMTPAuth(host string) (smtp.Auth, error) {
+	password := os.Getenv("SMTP_PASSWORD")
+	switch strings.ToLower(config.EmailAuth) {
+	case "":
+		return nil, nil
+	case smtpAuthPlain:
+		return smtp.PlainAuth("", config.EmailUsername, password, host), nil
+	case smtpAuthLogin:
+		return &loginAuth{config.EmailUsername, password}, nil
+	case smtpAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(config.EmailUsername, password), nil
+	}
+	return nil, fmt.Errorf("unsupported SMTP authentication: %s", config.EmailAuth)
+}
+
+func smtpConnect() (*smtp.Client, net.Conn, error) {
+	host, _, err := net.SplitHostPort(config.EmailServerAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	if strings.ToLower(config.EmailSecurity) == smtpSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", config.EmailServerAddress, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", config.EmailServerAddress)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// STARTTLS wraps conn, so the deadline also covers the encrypted session
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	switch strings.ToLower(config.EmailSecurity) {
+	case smtpSecurityTLS, smtpSecurityNone:
+	case "":
+		// Like smtp.SendMail, upgrade whenever the server offers it
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				_ = client.Close()
+				return nil, nil, err
+			}
+		}
+	case smtpSecurityStartTLS:
+		if err := client.StartTLS(tlsConfig); err != nil {
+			_ = client.Close()
+			return nil, nil, err
+		}
+	default:
+		_ = client.Close()
+		return nil, nil, fmt.Errorf("unsupported SMTP security: %s", config.EmailSecurity)
+	}
+	auth, err := getSMTPAuth(host)
+	if err == nil && auth != nil {
+		err = client.Auth(auth)
+	}
+	if err != nil {
+		_ = client.Close()
+		return nil, nil, err
+	}
+	return client, conn, nil
+}
+
+// Send a message over the shared session, reconnecting if the server dropped it
+func (mailer *SMTPMailer) Send(from string, to []string, msg []byte) error {
+	if mailer.client != nil {
+		_ = mailer.conn.SetDeadline(time.Now().Add(smtpTimeout))
+		if mailer.client.Noop() != nil {
+			_ = mailer.Close()
+		}
+	}
+	if mailer.client == nil {
+		client, conn, err := smtpConnect()
+		if err != nil {
+			return err
+		}
+		mailer.client, mailer.conn = client, conn
+	}
+	_ = mailer.conn.SetDeadline(time.Now().Add(smtpTimeout))
+	err := mailer.client.Mail(from)
+	for i := 0; err == nil && i < len(to); i++ {
+		err = mailer.client.Rcpt(to[i])
+	}
+	if err == nil {
+		w, dataErr := mailer.client.Data()
+		if err = dataErr; err == nil {
+			_, err = w.Write(msg)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err != nil && mailer.client.Reset() != nil {
+		_ = mailer.Close()
+	}
+	return err
+}
+
+func (mailer *SMTPMailer) Close() error {
+	if mailer.client == nil {
+		return nil
+	}
+	_ = mailer.conn.SetDeadline(time.Now().Add(smtpTimeout))
+	err := mailer.client.Quit()
+	if err != nil {
+		err = mailer.client.Close()
+	}
+	mailer.client, mailer.conn = nil, nil
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// Minimal SMTP server accepting a single session, without STARTTLS; it records the commands and message it receives
+func newFakeSMTP(t *testing.T) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	session := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		var received []string
+		defer func() { session <- received }()
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			received = append(received, line)
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "EHLO":
+				_ = tp.PrintfLine("250-localhost\r\n250 8BITMIME")
+			case "DATA":
+				_ = tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotLines()
+				if err != nil {
+					return
+				}
+				received = append(received, data...)
+				_ = tp.PrintfLine("250 queued")
+			case "QUIT":
+				_ = tp.PrintfLine("221 bye")
+				return
+			default:
+				_ = tp.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), session
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, session := newFakeSMTP(t)
+	saved := config
+	defer func() { config = saved }()
+	config.EmailServerAddress = addr
+	config.EmailSecurity = ""
+	config.EmailAuth = ""
+
+	mailer := &SMTPMailer{}
+	msg := "Subject: libft Nearing Update Deadline\r\n\r\nHello\r\n"
+	if err := mailer.Send("noreply@42.us.org", []string{"alogin@student.42.us.org"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	// The session is reused for the next message
+	if err := mailer.Send("noreply@42.us.org", []string{"blogin@student.42.us.org"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	received := strings.Join(<-session, "\n")
+	for _, want := range []string{
+		"MAIL FROM:<noreply@42.us.org>",
+		"RCPT TO:<alogin@student.42.us.org>",
+		"RCPT TO:<blogin@student.42.us.org>",
+		"Subject: libft Nearing Update Deadline",
+		"QUIT",
+	} {
+		if !strings.Contains(received, want) {
+			t.Errorf("session is missing %q:\n%s", want, received)
+		}
+	}
+}
+
+func TestSMTPConnectRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	saved := config
+	defer func() { config = saved }()
+	config.EmailServerAddress = addr
+
+	if err := (&SMTPMailer{}).Send("noreply@42.us.org", []string{"alogin@student.42.us.org"}, []byte("\r\n")); err == nil {
+		t.Error("expected an error without a server")
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -28,7 +30,14 @@ func sshConnect() error {
 	return err
 }
 
+// Quote s as a single word for the remote shell; single quotes can't be escaped inside single quotes, so each one
+// closes the quoted string, is escaped, and reopens it
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func sshRunCommand(cmd string) ([]byte, error) {
+	defer timeSSHCommand(time.Now())
 	session, err := sshConn.NewSession()
 	if err != nil {
 		return nil, err
@@ -36,3 +45,21 @@ func sshRunCommand(cmd string) ([]byte, error) {
 	defer session.Close()
 	return session.Output(cmd)
 }
+
+// Reuse the connection while the server still answers keepalives, reconnecting otherwise
+func ensureSSH() error {
+	if sshConn != nil {
+		if _, _, err := sshConn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return nil
+		}
+		closeSSH()
+	}
+	return sshConnect()
+}
+
+func closeSSH() {
+	if sshConn != nil {
+		_ = sshConn.Close()
+		sshConn = nil
+	}
+}
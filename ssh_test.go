@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	words := []string{
+		"alogin",
+		"",
+		"o'brien",
+		"x'; rm -rf / #",
+		"$(id) `id` \"double\" \\ *",
+		"''",
+	}
+	for _, word := range words {
+		// The quoted word must reach the command unchanged, as a single argument
+		out, err := exec.Command("sh", "-c", "printf '%s|' "+shellQuote(word)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != word+"|" {
+			t.Errorf("%q came out as %q", word, out)
+		}
+	}
+}
@@ -14,12 +14,26 @@ import (
 
 const (
 	CHEAT         = "CHEAT"
+	ERROR         = "ERROR"
+	EXEMPT        = "EXEMPT"
 	OK            = "OK"
 	STAGNANT      = "STAGNANT"
 	WARNED        = "WARNED"
 	gitTimeFormat = "Mon Jan 2 15:04:05 2006 -0700"
 )
 
+type TeamCheck struct {
+	Status     string
+	LastUpdate *time.Time
+	// Time inactivity is counted from: the last commit, or the last reopening if it is more recent
+	Since *time.Time
+	// Tightest warning stage the team has entered, if WARNED
+	Warning      *WarningStage
+	VacationTime time.Duration
+	// Time after which the team is stagnant unless it commits again
+	ExpiresAt time.Time
+}
+
 func getIntraIDs(team *intra.Team) []string {
 	intraIDs := make([]string, len(team.Users))
 	for i := range team.Users {
@@ -28,13 +42,25 @@ func getIntraIDs(team *intra.Team) []string {
 	return intraIDs
 }
 
-func getLastUpdate(team *intra.Team) (*time.Time, error) {
+// Return the date of the most recent commit, optionally restricted to commits whose author matches author
+func getLastUpdate(team *intra.Team, branches []string, author string) (*time.Time, error) {
 	path := strings.Split(strings.Split(team.RepoURL, ":")[1], "/")
 	path[len(path)-1] = team.RepoUUID
+	// Logins, repository paths and branches come from Intra and the config, so all of them are quoted
+	refs := ""
+	if author != "" {
+		refs += " --author=" + shellQuote(author)
+	}
+	if len(branches) > 0 {
+		refs += " --ignore-missing"
+		for _, branch := range branches {
+			refs += " " + shellQuote(branch)
+		}
+	}
 	cmd := fmt.Sprintf(
-		"git -C %s/%s log | grep 'Date:' | head -n1",
-		config.RepoPath,
-		strings.Join(path, "/"),
+		"git -C %s log%s | grep 'Date:' | head -n1",
+		shellQuote(config.RepoPath+"/"+strings.Join(path, "/")),
+		refs,
 	)
 	out, err := sshRunCommand(cmd)
 	if err != nil {
@@ -53,85 +79,131 @@ func getLastUpdate(team *intra.Team) (*time.Time, error) {
 	return &lastUpdate, nil
 }
 
+// Commits are attributed to a student when their login appears in the author name or address
+func getUserLastUpdate(team *intra.Team, login string) (*time.Time, error) {
+	// Not every command connects to the repository server
+	if sshConn == nil {
+		return nil, nil
+	}
+	return getLastUpdate(team, getPolicy(team).Branches, login)
+}
+
 func getProjectName(projectID int) string {
-	if name, present := projectNames[projectID]; present {
-		return name
+	projectCacheMu.Lock()
+	defer projectCacheMu.Unlock()
+	if !cacheProject(projectID) {
+		return "Unknown Project"
 	}
-	projectNamesCacheUpdated = true
+	return projectNames[projectID]
+}
+
+func getProjectSlug(projectID int) string {
+	projectCacheMu.Lock()
+	defer projectCacheMu.Unlock()
+	if !cacheProject(projectID) {
+		return ""
+	}
+	return projectSlugs[projectID]
+}
+
+// Fetch a project from Intra unless its name and slug are already cached; projectCacheMu must be held
+func cacheProject(projectID int) bool {
+	_, hasName := projectNames[projectID]
+	_, hasSlug := projectSlugs[projectID]
+	if hasName && hasSlug {
+		return true
+	}
+	projectCacheUpdated = true
 	project := &intra.Project{}
 	err := project.GetProject(context.Background(), false, projectID)
 	if err != nil {
-		outputErr(err, false)
-		return "Unknown Project"
+		logError(err, "step", stepIntra, "project_id", projectID)
+		return false
 	}
 	projectNames[projectID] = project.Name
-	return project.Name
+	projectSlugs[projectID] = project.Slug
+	return true
 }
 
-func loadProjectNames(path string) {
+func loadProjectCache(path string, cache *map[int]string) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return
 	}
 	data, err := ioutil.ReadFile(path)
 	if err == nil {
-		err = json.Unmarshal(data, &projectNames)
+		err = json.Unmarshal(data, cache)
 	}
 	if err != nil {
-		outputErr(err, false)
+		logError(err, "path", path)
 	}
 }
 
-func saveProjectNames(path string) {
-	data, err := json.Marshal(&projectNames)
+func saveProjectCache(path string, cache *map[int]string) {
+	data, err := json.Marshal(cache)
 	if err == nil {
 		err = ioutil.WriteFile(path, data, os.FileMode(0666))
 	}
 	if err != nil {
-		outputErr(err, false)
+		logError(err, "path", path)
 	}
 }
 
-// Checks if most recent commit in master branch is older than expirationDate
-func checkStagnant(team *intra.Team, midnight, expirationDate time.Time) (string, *time.Time, error) {
-	output(
-		"Checking\t<%d>\t%s\t(%s)...\t",
-		team.ID,
-		getProjectName(team.ProjectID),
-		strings.Join(getIntraIDs(team), ", "),
-	)
-	lastUpdate, err := getLastUpdate(team)
+// Status a team would get at midnight, without recording it
+func evaluateTeam(team *intra.Team, midnight time.Time) (*TeamCheck, error) {
+	policy := getPolicy(team)
+	expirationDate := policy.ExpirationDate(midnight)
+	lastUpdate, err := getLastUpdate(team, policy.Branches, "")
 	if err != nil {
-		output("ERROR\n")
-		return "", nil, err
+		return nil, err
+	}
+	reopenedAt, err := getLastReopen(team.ID)
+	if err != nil {
+		return nil, err
+	}
+	// Reverting a closure restarts the clock, since the team was told it had no deadline anymore
+	since := lastUpdate
+	if reopenedAt != nil && (lastUpdate == nil || reopenedAt.After(*lastUpdate)) {
+		since = reopenedAt
 	}
 	vacationTime := time.Duration(0)
 	if config.AllowVacations {
-		vacationTime = calcVacationTime(team, lastUpdate, midnight)
+		vacationTime = calcVacationTime(team, since, midnight)
 		expirationDate = expirationDate.Add(-vacationTime)
 	}
-	var last time.Time
-	var lastUpdateStr string
-	if lastUpdate == nil {
-		last = team.LockedAt
-		lastUpdateStr = "Never"
-	} else {
-		last = *lastUpdate
-		lastUpdateStr = lastUpdate.Local().Format(time.RFC1123)
+	last := team.LockedAt
+	if since != nil {
+		last = *since
 	}
-	var status string
+	// The cutoff trails midnight by the policy's allowance plus vacation credit, which the team has from the time it is inactive since
+	expiresAt := last.Add(midnight.Sub(expirationDate))
+	check := &TeamCheck{LastUpdate: lastUpdate, Since: since, VacationTime: vacationTime, ExpiresAt: expiresAt}
 	if last.Sub(expirationDate) <= 0 {
-		status = STAGNANT
-	} else if last.Add(-24*time.Hour).Sub(expirationDate) <= 0 {
-		status = WARNED
+		check.Status = STAGNANT
+	} else if check.Warning = policy.WarningStage(last, expirationDate); check.Warning != nil {
+		check.Status = WARNED
 	} else if last.Sub(time.Now().UTC()) > 0 {
-		status = CHEAT
+		check.Status = CHEAT
 	} else {
-		status = OK
+		check.Status = OK
 	}
-	output("%s\t[Last update: %s", status, lastUpdateStr)
-	if vacationTime != 0 {
-		output(" + %.1f vacation days", vacationTime.Hours()/24.0)
+	return check, nil
+}
+
+// Checks if most recent commit is older than the expiration date of the team's policy
+func checkStagnant(team *intra.Team, midnight time.Time) (*TeamCheck, error) {
+	log := teamLogger(team).With("project", getProjectName(team.ProjectID))
+	log.Debug("Checking team")
+	check, err := evaluateTeam(team, midnight)
+	if err != nil {
+		recordCheck(team, ERROR, nil, 0, nil, err)
+		return nil, err
 	}
-	output("]\n")
-	return status, lastUpdate, nil
+	log.Info("Team checked",
+		"status", check.Status,
+		"last_commit", check.LastUpdate,
+		"vacation_days", check.VacationTime.Hours()/24.0,
+		"policy", getPolicy(team).String(),
+	)
+	recordCheck(team, check.Status, check.LastUpdate, check.VacationTime, &check.ExpiresAt, nil)
+	return check, nil
 }
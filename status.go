@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+const defaultStatusLinkDays = 14
+
+type StatusLink struct {
+	Login string
+	URL   string
+}
+
+// What the next run would make of one of a student's teams
+type StatusTeam struct {
+	TeamID       int        `json:"team_id"`
+	Project      string     `json:"project"`
+	Logins       []string   `json:"logins"`
+	LastCommit   *time.Time `json:"last_commit"`
+	VacationDays float64    `json:"vacation_days"`
+	// Time after which the team is stagnant unless it commits again
+	ExpiresAt *time.Time `json:"expires_at"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type StudentStatus struct {
+	Login   string       `json:"login"`
+	NextRun time.Time    `json:"next_run"`
+	Teams   []StatusTeam `json:"teams"`
+}
+
+// Links are signed with STATUS_SECRET over the login and expiry, so students can only see their own teams
+func signStatusLink(login string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("STATUS_SECRET")))
+	_, _ = mac.Write([]byte(login + "." + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Link to a student's status page, or "" if the status page isn't set up
+func statusLink(login string) string {
+	if config.StatusURL == "" || os.Getenv("STATUS_SECRET") == "" {
+		return ""
+	}
+	expires := time.Now().Add(time.Duration(config.StatusLinkDays) * 24 * time.Hour).Unix()
+	params := url.Values{}
+	params.Set("login", login)
+	params.Set("expires", strconv.FormatInt(expires, 10))
+	params.Set("sig", signStatusLink(login, expires))
+	return config.StatusURL + "?" + params.Encode()
+}
+
+func getStatusLinks(logins string) []StatusLink {
+	var links []StatusLink
+	for _, login := range strings.Split(logins, ",") {
+		if link := statusLink(login); login != "" && link != "" {
+			links = append(links, StatusLink{login, link})
+		}
+	}
+	return links
+}
+
+// Return the login a request's link was signed for, or "" if the link is invalid or expired
+func verifyStatusLink(r *http.Request) string {
+	login := r.FormValue("login")
+	expires, err := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+	if os.Getenv("STATUS_SECRET") == "" || login == "" || err != nil || time.Now().Unix() > expires {
+		return ""
+	}
+	if !hmac.Equal([]byte(r.FormValue("sig")), []byte(signStatusLink(login, expires))) {
+		return ""
+	}
+	return login
+}
+
+// Teams of a student that runs would check, as getEligibleTeams selects them
+func getStudentTeams(login string) (intra.Teams, error) {
+	// Runs resolve the scope, but the page may be used before the first one
+	if projectScope == nil {
+		if err := resolveProjectScope(); err != nil {
+			return nil, err
+		}
+	}
+	params := url.Values{}
+	params.Set("page[size]", "100")
+	teams := &intra.Teams{}
+	if err := teams.GetUserTeams(context.Background(), login, params); err != nil {
+		return nil, err
+	}
+	var res intra.Teams
+	for _, team := range *teams {
+		if team.Closed || !team.Locked || team.LockedAt.Before(config.ProjectStartingRange) || !isEligibleTeam(&team) {
+			continue
+		}
+		// Policies may depend on the cursus the team was retrieved through, which only runs know
+		if _, present := teamCursus[team.ID]; !present {
+			cursusID, err := getLastCheckCursus(team.ID)
+			if err != nil {
+				return nil, err
+			}
+			if cursusID != 0 {
+				teamCursus[team.ID] = cursusID
+			}
+		}
+		res = append(res, team)
+	}
+	return res, nil
+}
+
+// Evaluate a student's teams as of the next run's midnight
+func getStudentStatus(login string) (*StudentStatus, error) {
+	daemonMu.Lock()
+	next := nextRunAt
+	daemonMu.Unlock()
+	if next.IsZero() {
+		next = time.Now()
+	}
+	if err := ensureSSH(); err != nil {
+		return nil, err
+	}
+	teams, err := getStudentTeams(login)
+	if err != nil {
+		return nil, err
+	}
+	exemptions, err := getExemptions(false)
+	if err != nil {
+		return nil, err
+	}
+	status := &StudentStatus{Login: login, NextRun: next, Teams: []StatusTeam{}}
+	midnight := getMidnight(next)
+	for i := range teams {
+		team := &teams[i]
+		entry := StatusTeam{
+			TeamID:  team.ID,
+			Project: getProjectName(team.ProjectID),
+			Logins:  getIntraIDs(team),
+		}
+		if findExemption(exemptions, team) != nil {
+			entry.Status = EXEMPT
+			status.Teams = append(status.Teams, entry)
+			continue
+		}
+		check, err := evaluateTeam(team, midnight)
+		if err != nil {
+			logError(err, "step", stepServe, "team_id", team.ID, "login", login)
+			entry.Status = ERROR
+			entry.Error = "Could not be checked, please try again later"
+		} else {
+			entry.Status = check.Status
+			entry.LastCommit = check.LastUpdate
+			entry.VacationDays = check.VacationTime.Hours() / 24.0
+			entry.ExpiresAt = &check.ExpiresAt
+		}
+		status.Teams = append(status.Teams, entry)
+	}
+	return status, nil
+}
+
+// Serves the page at /status and the same data as JSON at /status.json
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	login := verifyStatusLink(r)
+	if login == "" {
+		http.Error(w, "This link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+	// Runs use the same connections and caches, and take a few minutes at most
+	if !runMu.TryLock() {
+		w.Header().Set("Retry-After", "300")
+		http.Error(w, "GitCreeper is checking projects right now, please try again in a few minutes",
+			http.StatusServiceUnavailable)
+		return
+	}
+	status, err := getStudentStatus(login)
+	runMu.Unlock()
+	if err != nil {
+		logError(err, "step", stepServe, "login", login)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+	lang := getUserLanguage(login)
+	tfs := getTemplateFS()
+	name := localizedTemplate(tfs, lang, "status.html")
+	tmpl, err := htmltemplate.New("status.html").Funcs(htmltemplate.FuncMap(templateFuncs(lang))).ParseFS(tfs, name)
+	if err == nil {
+		buff := &strings.Builder{}
+		data := struct {
+			*StudentStatus
+			Branding Branding
+		}{status, config.Branding}
+		if err = tmpl.Execute(buff, data); err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(buff.String()))
+			return
+		}
+	}
+	logError(err, "step", stepServe, "template", name)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+func mountStatus(mux *http.ServeMux) {
+	if os.Getenv("STATUS_SECRET") == "" {
+		logger.Warn("STATUS_SECRET is not set, the student status page is disabled")
+		return
+	}
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/status.json", statusHandler)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitcreeper/intra"
+)
+
+const defaultTemplatePath = "templates"
+
+// Built-in templates, used for any file missing from the configured template directory
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+type (
+	BrandingLink struct {
+		Name    string
+		URL     string
+		IconURL string
+	}
+	Branding struct {
+		CampusName     string
+		WebsiteURL     string
+		LogoURL        string
+		Address        []string
+		UnsubscribeURL string
+		SocialLinks    []BrandingLink
+		SubjectPrefix  string
+	}
+)
+
+// Serves files from the template directory, falling back to the embedded templates
+type templateFS struct {
+	dir string
+}
+
+func (tfs templateFS) Open(name string) (fs.File, error) {
+	f, err := os.DirFS(tfs.dir).Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	return embeddedTemplates.Open("templates/" + name)
+}
+
+func getTemplateFS() fs.FS {
+	return templateFS{config.TemplatePath}
+}
+
+// Render an email for a team to a file without sending it
+// The format depends on the extension: .html and .txt write a single part, anything else the whole message
+func templatePreviewCommand(args []string) error {
+	flags := flag.NewFlagSet("preview", flag.ExitOnError)
+	out := flags.String("out", "", "file to write the rendered email to (default preview-<type>-<team-id>.eml)")
+	lang := flags.String("lang", "", "language to render, instead of the team's preferred language")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: gitcreeper template preview [--out <file>] [--lang <language>] <type> <team-id>")
+	}
+	emailType := flags.Arg(0)
+	teamID, err := strconv.Atoi(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("preview-%s-%d.eml", emailType, teamID)
+	}
+	team := &intra.Team{}
+	if err := team.GetTeam(context.Background(), false, teamID); err != nil {
+		return err
+	}
+	if team.ID == 0 {
+		return fmt.Errorf("team %d not found", teamID)
+	}
+	var lastUpdate *time.Time
+	if err := sshConnect(); err != nil {
+		logger.Warn("Could not connect to the repository server, previewing without a last commit", "error", err)
+	} else {
+		defer sshConn.Close()
+		if lastUpdate, err = getLastUpdate(team, getPolicy(team).Branches, ""); err != nil {
+			return err
+		}
+	}
+	vars := map[string]string{}
+	// Warning templates are previewed with the first stage that uses them
+	for _, stage := range getPolicy(team).WarningSchedule {
+		if stage.Template == emailType {
+			vars = getWarningVars(&stage, time.Time{})
+			break
+		}
+	}
+	setEmailVars(team, lastUpdate, vars)
+	to := make([]string, len(team.Users))
+	for i := range team.Users {
+		to[i] = studentAddress(team.Users[i].Login)
+	}
+	vars["to"] = strings.Join(to, ",")
+	vars["language"] = *lang
+	if *lang == "" {
+		vars["language"] = getTeamLanguage(team)
+	}
+	msg, err := composeEmail(emailType, vars, getPolicy(team))
+	if err != nil {
+		return err
+	}
+	var data []byte
+	switch strings.ToLower(filepath.Ext(*out)) {
+	case ".html", ".htm":
+		data = []byte(msg.HTML)
+	case ".txt":
+		data = []byte(msg.Text)
+	default:
+		if data, err = msg.Bytes(); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(*out, data, os.FileMode(0644)); err != nil {
+		return err
+	}
+	fmt.Printf("%s preview for team %d written to %s\n", emailType, teamID, *out)
+	return nil
+}
+
+func templateCommand(args []string) error {
+	if len(args) == 0 || args[0] != "preview" {
+		return errors.New("usage: gitcreeper template preview [--out <file>] [--lang <language>] <type> <team-id>")
+	}
+	return templatePreviewCommand(args[1:])
+}
@@ -33,7 +33,7 @@ func (vt *VacationTime) UnmarshalJSON(data []byte) error {
 		vt.Time = time.Time{}.UTC()
 		return nil
 	}
-	date, err := time.ParseInLocation(portalVacationFormat, raw, time.Local)
+	date, err := time.ParseInLocation(portalVacationFormat, raw, location)
 	if err == nil {
 		vt.Time = date.UTC()
 	}
@@ -82,26 +82,52 @@ func getVacations(login string) ([]Vacation, error) {
 	return vacations, err
 }
 
+// Vacation days only count after the last update, or after the team was locked if it never committed
+func vacationWindowStart(team *intra.Team, lastUpdate *time.Time) time.Time {
+	if lastUpdate == nil {
+		return team.LockedAt
+	}
+	// Update day can't be part of the vacation window
+	return lastUpdate.Add(24 * time.Hour)
+}
+
+func countVacationDays(login string, last, midnight time.Time) (int, error) {
+	vacations, err := getVacations(login)
+	if err != nil {
+		metricVacationErrors.Inc()
+		return 0, err
+	}
+	days := 0
+	for _, v := range vacations {
+		days += v.countApplicableDays(last, midnight)
+	}
+	return days, nil
+}
+
+// Return the vacation days a single team member has been credited with since the team's last update
+func getUserVacationDays(team *intra.Team, login string, lastUpdate *time.Time) int {
+	if !config.AllowVacations {
+		return 0
+	}
+	days, err := countVacationDays(login, vacationWindowStart(team, lastUpdate), getMidnight(time.Now()))
+	if err != nil {
+		logError(err, "step", stepVacation, "team_id", team.ID, "login", login)
+	}
+	return days
+}
+
 // Return extra vacation time to extend project expiration date
 // Vacation time is averaged from applicable vacation days for all team members
 func calcVacationTime(team *intra.Team, lastUpdate *time.Time, midnight time.Time) time.Duration {
-	var last time.Time
-	if lastUpdate == nil {
-		last = team.LockedAt
-	} else {
-		// Update day can't be part of the vacation window
-		last = lastUpdate.Add(24 * time.Hour)
-	}
+	last := vacationWindowStart(team, lastUpdate)
 	days := 0
 	for _, user := range team.Users {
-		vacations, err := getVacations(user.Login)
+		userDays, err := countVacationDays(user.Login, last, midnight)
 		if err != nil {
-			outputErr(err, false)
+			logError(err, "step", stepVacation, "team_id", team.ID, "login", user.Login)
 			continue
 		}
-		for _, v := range vacations {
-			days += v.countApplicableDays(last, midnight)
-		}
+		days += userDays
 	}
 	return (time.Duration(days) * 24 * time.Hour) / time.Duration(len(team.Users))
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	teamWarnedEvent         = "team.warned"
+	teamClosedEvent         = "team.closed"
+	teamCheatSuspectedEvent = "team.cheat_suspected"
+	runCompletedEvent       = "run.completed"
+	defaultWebhookAttempts  = 3
+	webhookRetryBase        = time.Second
+	webhookTimeout          = 10 * time.Second
+)
+
+type Webhook struct {
+	URL string
+	// Event types delivered to this target; every event if empty
+	Events []string
+	// Environment variable holding the secret used to sign payloads
+	SecretEnv string
+}
+
+// Run totals sent with run.completed, without the per-team records
+type RunSummary struct {
+	Day        string         `json:"day"`
+	Prelaunch  bool           `json:"prelaunch"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Totals     map[string]int `json:"totals"`
+	Skipped    int            `json:"skipped"`
+	Errors     int            `json:"errors"`
+}
+
+type WebhookEvent struct {
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	RunID string      `json:"run_id"`
+	Time  time.Time   `json:"time"`
+	Team  *TeamRecord `json:"team,omitempty"`
+	Run   *RunSummary `json:"run,omitempty"`
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+func (hook *Webhook) accepts(eventType string) bool {
+	return len(hook.Events) == 0 || containsString(hook.Events, eventType)
+}
+
+// Receivers verify X-GitCreeper-Signature against HMAC-SHA256("<timestamp>.<body>") and reject stale timestamps
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(timestamp + "."))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(hook *Webhook, event *WebhookEvent, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GitCreeper")
+	req.Header.Set("X-GitCreeper-Event", event.Type)
+	req.Header.Set("X-GitCreeper-Delivery", event.ID)
+	req.Header.Set("X-GitCreeper-Timestamp", timestamp)
+	if hook.SecretEnv != "" {
+		req.Header.Set("X-GitCreeper-Signature", signWebhook(os.Getenv(hook.SecretEnv), timestamp, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return respBody, fmt.Errorf("webhook %s: %s", hook.URL, resp.Status)
+	}
+	return respBody, nil
+}
+
+// Deliver to a single target, retrying with an exponentially increasing delay
+func deliverWebhook(hook *Webhook, event *WebhookEvent, body []byte) error {
+	delay := webhookRetryBase
+	var err error
+	for attempt := 1; attempt <= config.WebhookMaxAttempts; attempt++ {
+		var resp []byte
+		resp, err = postWebhook(hook, event, body)
+		teamID := 0
+		if event.Team != nil {
+			teamID = event.Team.TeamID
+		}
+		recordAction("webhook", teamID, fmt.Sprintf("%s to %s (attempt %d)", event.Type, hook.URL, attempt), nil, resp, err)
+		if err == nil {
+			return nil
+		}
+		if attempt < config.WebhookMaxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+func emitEvent(event *WebhookEvent) {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+	event.RunID = currentRunID()
+	event.Time = time.Now().UTC()
+	event.ID = fmt.Sprintf("%s-%s-%d", currentRunID(), event.Type, event.Time.UnixNano())
+	body, err := json.Marshal(event)
+	if err != nil {
+		logError(err, "step", stepWebhook, "event", event.Type)
+		return
+	}
+	for i := range config.Webhooks {
+		hook := &config.Webhooks[i]
+		if !hook.accepts(event.Type) {
+			continue
+		}
+		if err := deliverWebhook(hook, event, body); err != nil {
+			logError(err, "step", stepWebhook, "event", event.Type, "url", hook.URL)
+		}
+	}
+}
+
+func emitTeamEvent(eventType string, record TeamRecord) {
+	emitEvent(&WebhookEvent{Type: eventType, Team: &record})
+}
+
+func emitRunCompleted(report *RunReport) {
+	emitEvent(&WebhookEvent{
+		Type: runCompletedEvent,
+		Run: &RunSummary{
+			Day:        report.Day,
+			Prelaunch:  report.Prelaunch,
+			StartedAt:  report.StartedAt,
+			FinishedAt: report.FinishedAt,
+			Totals:     report.Totals,
+			Skipped:    report.Skipped,
+			Errors:     len(report.Errors),
+		},
+	})
+}